@@ -0,0 +1,162 @@
+package popart
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrAddressDenied is the reason for rejecting a connection from an
+	// address which the Server's AccessControl does not allow.
+	ErrAddressDenied = NewCodedError(CodeSysPerm, "access denied from your address")
+
+	errUserAddressDenied = NewCodedError(CodeAuth, "access denied from your address")
+)
+
+// AccessRules lists networks, in CIDR notation (e.g. "10.0.0.0/8"), or single
+// IP addresses which clients may or may not connect from. Deny rules take
+// precedence over Allow rules, and an empty Allow list allows all addresses
+// that are not denied.
+type AccessRules struct {
+	Allow []string
+	Deny  []string
+}
+
+// AccessControl restricts client addresses, either globally or for particular
+// users. Global rules are checked as soon as a connection is accepted while
+// per-user rules are checked once the user has authenticated. The zero value
+// allows everything. It is safe for concurrent use, so rules can be reloaded
+// while the server is running.
+type AccessControl struct {
+	mu     sync.RWMutex
+	global *ipRules
+	users  map[string]*ipRules
+}
+
+// Reload replaces all the rules: the global ones and the ones for particular
+// users, keyed by username. If any of the rules is invalid, an error is
+// returned and the previous rules remain in effect.
+func (a *AccessControl) Reload(global AccessRules, users map[string]AccessRules) error {
+	globalRules, err := parseAccessRules(global)
+	if err != nil {
+		return err
+	}
+	userRules := make(map[string]*ipRules, len(users))
+	for username, rules := range users {
+		if userRules[username], err = parseAccessRules(rules); err != nil {
+			return fmt.Errorf("rules for %q: %v", username, err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.global, a.users = globalRules, userRules
+	return nil
+}
+
+// allowPeer checks the address against the global rules.
+func (a *AccessControl) allowPeer(peer net.Addr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.global.allows(peer)
+}
+
+// allowUser checks the address against the rules for the given user.
+func (a *AccessControl) allowUser(username string, peer net.Addr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[username].allows(peer)
+}
+
+type ipRules struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseAccessRules(rules AccessRules) (*ipRules, error) {
+	allow, err := parseNetworks(rules.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNetworks(rules.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipRules{allow: allow, deny: deny}, nil
+}
+
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", network)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+// allows tells whether the rules let the peer in. Nil rules allow everything
+// while peers without an IP address are only allowed if there are no Allow
+// rules.
+func (r *ipRules) allows(peer net.Addr) bool {
+	if r == nil {
+		return true
+	}
+	ip := addrIP(peer)
+	if ip == nil {
+		return len(r.allow) == 0
+	}
+	if containsIP(r.deny, ip) {
+		return false
+	}
+	return len(r.allow) == 0 || containsIP(r.allow, ip)
+}
+
+// addrIP returns the IP address of the peer, or nil if it has none. The zone
+// of an IPv6 address (e.g. "fe80::1%eth0") is dropped since rules do not
+// mention zones.
+func addrIP(peer net.Addr) net.IP {
+	if tcpAddr, ok := peer.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	addr, err := netip.ParseAddr(peerIP(peer))
+	if err != nil {
+		return nil
+	}
+	return net.IP(addr.WithZone("").AsSlice())
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserAccess refuses the login if the user is not allowed to connect
+// from the client's address.
+func (s *session) checkUserAccess() error {
+	access := s.server.AccessControl
+	if access == nil || access.allowUser(s.username, s.rawConn.RemoteAddr()) {
+		return nil
+	}
+	return errUserAddressDenied
+}
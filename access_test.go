@@ -0,0 +1,30 @@
+package popart
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessRulesApplyToZonedAddresses(t *testing.T) {
+	rules, err := parseAccessRules(AccessRules{Deny: []string{"fe80::/10", "10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		peer    net.Addr
+		allowed bool
+	}{
+		{pipeAddr("[fe80::1%eth0]:110"), false},
+		{pipeAddr("fe80::1%eth0"), false},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 110, Zone: "eth0"}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 110}, false},
+		{pipeAddr("[::ffff:10.0.0.1]:110"), false},
+		{pipeAddr("[2001:db8::1%eth0]:110"), true},
+		{pipeAddr("10.0.0.2:110"), true},
+		{pipeAddr("pipe"), true},
+	} {
+		if allowed := rules.allows(tc.peer); allowed != tc.allowed {
+			t.Errorf("allows(%v) = %t, expected %t", tc.peer, allowed, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package popart
+
+import (
+	"context"
+	"io"
+)
+
+var errAPOPUnsupported = NewCodedError(CodeSysPerm, "APOP not supported")
+
+// Backend is an alternative to Handler for servers which would rather not
+// build a stateful object for every connection. A single Backend, typically
+// shared by all sessions, authenticates users and gives access to their
+// maildrops through Mailbox objects.
+//
+// Backends can implement the same optional interfaces as handlers, e.g.
+// APOPSecretProvider or TokenAuthenticator. In that case the Authorize method
+// only needs to decide whether the user is allowed to log in since the server
+// will obtain the user's maildrop with the Mailbox method.
+type Backend interface {
+	// Login verifies the user's password and returns the user's maildrop.
+	Login(ctx context.Context, username, password string) (Mailbox, error)
+
+	// Mailbox returns the maildrop of a user whose credentials have
+	// already been verified by other means, e.g. by the server itself
+	// using SCRAM or by the Backend's AuthenticateToken method.
+	Mailbox(ctx context.Context, username string) (Mailbox, error)
+}
+
+// Mailbox provides access to a single user's maildrop. Just like in Handler,
+// messages are identified by their ordinal numbers. The context passed to
+// each method is the same as the one passed to ContextHandler methods.
+type Mailbox interface {
+	// Lock puts a global lock on the maildrop so that any concurrent
+	// sessions attempting to access it fail until Unlock is called. It
+	// should return an error if it is not possible to lock the maildrop,
+	// ErrMaildropInUse if it is locked by another session.
+	Lock(ctx context.Context) error
+
+	// Unlock releases the lock taken by Lock. It is generally the very
+	// last method called on a Mailbox.
+	Unlock(ctx context.Context) error
+
+	// DeleteMessages deletes messages with the given numbers. If it fails
+	// it is expected that *none* of the messages will be deleted.
+	DeleteMessages(ctx context.Context, numbers []uint64) error
+
+	// GetMessageReader returns the content of a message. The server will
+	// take care of closing it.
+	GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error)
+
+	// GetMessageCount returns the number of messages in the maildrop.
+	GetMessageCount(ctx context.Context) (uint64, error)
+
+	// GetMessageID returns the message's unique ID that is persistent
+	// between sessions.
+	GetMessageID(ctx context.Context, number uint64) (string, error)
+
+	// GetMessageSize returns the message's size in bytes. See Handler's
+	// GetMessageSize for details.
+	GetMessageSize(ctx context.Context, number uint64) (uint64, error)
+}
+
+// SessionErrorHandler is an optional interface for Backends which want to be
+// notified of errors produced by the code *outside* of the Backend, much like
+// Handler's HandleSessionError.
+type SessionErrorHandler interface {
+	HandleSessionError(ctx context.Context, err error)
+}
+
+// backendAdapter serves a single session using a Backend.
+type backendAdapter struct {
+	backend  Backend
+	mailbox  Mailbox
+	username string // owner of the mailbox
+}
+
+func (b *backendAdapter) AuthenticatePASS(ctx context.Context, username, password string) error {
+	mailbox, err := b.backend.Login(ctx, username, password)
+	if err != nil {
+		return err
+	}
+	b.mailbox, b.username = mailbox, username
+	return nil
+}
+
+func (b *backendAdapter) AuthenticateAPOP(ctx context.Context, username, hexdigest string) error {
+	// Backends can only support APOP by implementing APOPSecretProvider in
+	// which case this method is not called at all.
+	return errAPOPUnsupported
+}
+
+func (b *backendAdapter) DeleteMessages(ctx context.Context, numbers []uint64) error {
+	return b.mailbox.DeleteMessages(ctx, numbers)
+}
+
+func (b *backendAdapter) GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error) {
+	return b.mailbox.GetMessageReader(ctx, number)
+}
+
+func (b *backendAdapter) GetMessageCount(ctx context.Context) (uint64, error) {
+	return b.mailbox.GetMessageCount(ctx)
+}
+
+func (b *backendAdapter) GetMessageID(ctx context.Context, number uint64) (string, error) {
+	return b.mailbox.GetMessageID(ctx, number)
+}
+
+func (b *backendAdapter) GetMessageSize(ctx context.Context, number uint64) (uint64, error) {
+	return b.mailbox.GetMessageSize(ctx, number)
+}
+
+func (b *backendAdapter) HandleSessionError(ctx context.Context, err error) {
+	if handler, ok := b.backend.(SessionErrorHandler); ok {
+		handler.HandleSessionError(ctx, err)
+	}
+}
+
+func (b *backendAdapter) LockMaildrop(ctx context.Context) error {
+	return b.mailbox.Lock(ctx)
+}
+
+func (b *backendAdapter) SetBanner(ctx context.Context, banner string) error {
+	return nil // the server keeps the banner itself
+}
+
+func (b *backendAdapter) UnlockMaildrop(ctx context.Context) error {
+	if b.mailbox == nil {
+		return nil // no user, no maildrop to unlock
+	}
+	return b.mailbox.Unlock(ctx)
+}
+
+// bindUser obtains the user's Mailbox if the user has been authenticated by
+// other means than Backend's Login method.
+func (b *backendAdapter) bindUser(ctx context.Context, username string) error {
+	if b.mailbox != nil && b.username == username {
+		return nil
+	}
+	mailbox, err := b.backend.Mailbox(ctx, username)
+	if err != nil {
+		return err
+	}
+	b.mailbox, b.username = mailbox, username
+	return nil
+}
+
+// unbindUser forgets the Mailbox obtained for a user who turned out not to
+// be allowed in, so that the session goes back to using the Backend.
+func (b *backendAdapter) unbindUser() {
+	b.mailbox, b.username = nil, ""
+}
+
+// unwrap makes optional interfaces be looked up on the Backend before the
+// user is authenticated and on their Mailbox afterwards.
+func (b *backendAdapter) unwrap() interface{} {
+	if b.mailbox != nil {
+		return b.mailbox
+	}
+	return b.backend
+}
+
+// userBinder is implemented by handler adapters which need to know the name of
+// the authenticated user before the maildrop is locked.
+type userBinder interface {
+	bindUser(ctx context.Context, username string) error
+	unbindUser()
+}
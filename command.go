@@ -0,0 +1,195 @@
+package popart
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// Session states in which commands can be issued.
+// RFC 1939, page 2.
+const (
+	StateAuthorization = stateAuthorization
+	StateTransaction   = stateTransaction
+)
+
+// CommandHandler is a callback invoked when the client issues a custom command.
+// The arguments do not include the name of the command itself. Just like with
+// handler methods, returning a ReportableError results in a negative response
+// to the client while any other error terminates the session.
+type CommandHandler func(sess *Session, args []string) error
+
+// Command describes a custom command which can be registered with a Server,
+// either as an extension or in place of one of the built-in commands.
+type Command struct {
+	// States lists session states in which the command is allowed
+	// (StateAuthorization and/or StateTransaction).
+	States []int
+
+	// Arities lists numbers of arguments the command accepts.
+	Arities []int
+
+	// Secure marks the command as one which transmits credentials. If the
+	// server requires TLS, the command will be refused over plaintext
+	// connections.
+	Secure bool
+
+	// Handler is called once the command has been validated.
+	Handler CommandHandler
+
+	// Capability, if not empty, is announced to the client in response to
+	// CAPA. Commands replacing built-in ones are announced as before and
+	// need not set it. RFC 2449, page 3.
+	Capability string
+}
+
+// verify checks that the command registered under the given name can
+// actually be issued and handled.
+func (c *Command) verify(name string) error {
+	if c.Handler == nil {
+		return fmt.Errorf("command %s: no Handler", name)
+	}
+	if len(c.States) == 0 || len(c.Arities) == 0 {
+		return fmt.Errorf("command %s: States and Arities must not be empty", name)
+	}
+	for _, st := range c.States {
+		if st != StateAuthorization && st != StateTransaction {
+			return fmt.Errorf("command %s: invalid state %d", name, st)
+		}
+	}
+	return nil
+}
+
+func (c *Command) validator() *validator {
+	opts := []option{state(c.States...), arity(c.Arities...)}
+	if c.Secure {
+		opts = append(opts, secure())
+	}
+	return validates(opts...)
+}
+
+func (c *Command) operationHandler() operationHandler {
+	return func(s *session, args []string) error {
+		return c.Handler(&Session{session: s}, args)
+	}
+}
+
+// lookupCommand finds the command with the given upper-case name, preferring
+// the ones registered with the Server over the built-in ones.
+func (s *Server) lookupCommand(name string) (*validator, operationHandler, bool) {
+	if cmd, exists := s.Commands[name]; exists {
+		if cmd == nil {
+			return nil, nil, false // built-in command disabled
+		}
+		return cmd.validator(), cmd.operationHandler(), true
+	}
+	cmdValidator, exists := validators[name]
+	return cmdValidator, operationHandlers[name], exists
+}
+
+// hasCommand tells whether the command with the given upper-case name has not
+// been disabled.
+func (s *Server) hasCommand(name string) bool {
+	if cmd, exists := s.Commands[name]; exists {
+		return cmd != nil
+	}
+	_, exists := validators[name]
+	return exists
+}
+
+// commandCapabilities returns capabilities announced by the commands
+// registered with the Server, ordered by command name.
+func (s *Server) commandCapabilities() []string {
+	var names []string
+	for name, cmd := range s.Commands {
+		if cmd != nil && cmd.Capability != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, s.Commands[name].Capability)
+	}
+	return ret
+}
+
+// Session gives custom command handlers access to the client session they
+// are invoked in. It is only valid for the duration of the CommandHandler
+// call.
+type Session struct {
+	session *session
+}
+
+// Context returns the context of the session, the same one that is passed to
+// ContextHandler methods.
+func (s *Session) Context() context.Context {
+	return s.session.ctx
+}
+
+// Handler returns the handler of the session.
+func (s *Session) Handler() ContextHandler {
+	return s.session.handler
+}
+
+// ID returns the identifier of the session, as used by the Server's Sessions
+// and TerminateSession methods.
+func (s *Session) ID() uint64 {
+	return s.session.id
+}
+
+// RemoteAddr returns the address of the client.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.session.rawConn.RemoteAddr()
+}
+
+// TLS returns the state of the TLS connection, or nil if the connection is not
+// secured.
+func (s *Session) TLS() *tls.ConnectionState {
+	return s.session.tlsState()
+}
+
+// State returns the current state of the session, either StateAuthorization
+// or StateTransaction.
+func (s *Session) State() int {
+	return s.session.state
+}
+
+// Username returns the name the client has provided with the USER command or
+// authenticated as. It may be empty in the authorization state.
+func (s *Session) Username() string {
+	return s.session.username
+}
+
+// MessageCount returns the number of messages in the maildrop which have not
+// been marked as deleted. It is only meaningful in the transaction state.
+func (s *Session) MessageCount() uint64 {
+	return s.session.getMessageCount()
+}
+
+// MaildropSize returns the total size of messages in the maildrop which have
+// not been marked as deleted. It is only meaningful in the transaction state.
+func (s *Session) MaildropSize() uint64 {
+	return s.session.getMaildropSize()
+}
+
+// RespondOK writes a single-line positive response to the client, with
+// printf-like formatting.
+func (s *Session) RespondOK(format string, args ...interface{}) error {
+	return s.session.respondOK(format, args...)
+}
+
+// RespondMultiline writes the first line of a positive multi-line response to
+// the client and returns a writer for the rest of it. Lines written to it are
+// dot-stuffed and the response is terminated once the writer is closed, which
+// must happen before the CommandHandler returns.
+// RFC 1939, page 2.
+func (s *Session) RespondMultiline(format string, args ...interface{}) (io.WriteCloser, error) {
+	if err := s.session.respondOK(format, args...); err != nil {
+		return nil, err
+	}
+	return s.session.writer.DotWriter(), nil
+}
@@ -0,0 +1,56 @@
+package popart
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIncompleteCommandsAreRejected(t *testing.T) {
+	handler := func(sess *Session, args []string) error { return nil }
+	for name, cmd := range map[string]*Command{
+		"NOHANDLER": {States: []int{StateTransaction}, Arities: []int{0}},
+		"NOSTATES":  {Arities: []int{0}, Handler: handler},
+		"NOARITIES": {States: []int{StateTransaction}, Handler: handler},
+		"BADSTATE":  {States: []int{42}, Arities: []int{0}, Handler: handler},
+	} {
+		srv := &Server{
+			Backend:  newTestBackend(),
+			Timeout:  10 * time.Minute,
+			Commands: map[string]*Command{name: cmd},
+		}
+		err := srv.Serve(newPipeListener())
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: got %v, expected the command to be rejected", name, err)
+		}
+	}
+}
+
+func TestCustomCommands(t *testing.T) {
+	srv := &Server{
+		Backend: newTestBackend("a\r\n", "bc\r\n"),
+		Commands: map[string]*Command{
+			"XSIZE": {
+				States:     []int{StateTransaction},
+				Arities:    []int{0},
+				Capability: "XSIZE",
+				Handler: func(sess *Session, args []string) error {
+					return sess.RespondOK("%s %d", sess.Username(), sess.MaildropSize())
+				},
+			},
+			"TOP": nil,
+		},
+	}
+	client := serveTest(t, srv).dial(t)
+	client.line()
+	client.expect("-ERR", "XSIZE")
+	client.expect("+OK", "USER alice")
+	client.expect("+OK", "PASS secret")
+	client.expect("+OK alice 7", "XSIZE")
+	client.expect("-ERR", "TOP 1 0")
+	client.expect("+OK", "CAPA")
+	lines := client.lines()
+	if !contains(lines, "XSIZE") || contains(lines, "TOP") {
+		t.Errorf("unexpected capabilities: %q", lines)
+	}
+}
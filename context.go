@@ -0,0 +1,102 @@
+package popart
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+type contextKey int
+
+const (
+	peerAddrKey contextKey = iota
+	sessionIDKey
+)
+
+// PeerAddrFromContext returns the address of the POP3 client from the context
+// passed to ContextHandler methods.
+func PeerAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(peerAddrKey).(net.Addr)
+	return addr, ok
+}
+
+// SessionIDFromContext returns the ID of the session (see SessionInfo) from
+// the context passed to ContextHandler methods.
+func SessionIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(sessionIDKey).(uint64)
+	return id, ok
+}
+
+// NewContextHandler adapts a Handler to the ContextHandler interface by simply
+// ignoring the context. Optional interfaces implemented by the Handler (e.g.
+// APOPSecretProvider) are still honoured by the server.
+func NewContextHandler(handler Handler) ContextHandler {
+	return &handlerAdapter{handler: handler}
+}
+
+type handlerAdapter struct {
+	handler Handler
+}
+
+func (h *handlerAdapter) AuthenticatePASS(ctx context.Context, username, password string) error {
+	return h.handler.AuthenticatePASS(username, password)
+}
+
+func (h *handlerAdapter) AuthenticateAPOP(ctx context.Context, username, hexdigest string) error {
+	return h.handler.AuthenticateAPOP(username, hexdigest)
+}
+
+func (h *handlerAdapter) DeleteMessages(ctx context.Context, numbers []uint64) error {
+	return h.handler.DeleteMessages(numbers)
+}
+
+func (h *handlerAdapter) GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error) {
+	return h.handler.GetMessageReader(number)
+}
+
+func (h *handlerAdapter) GetMessageCount(ctx context.Context) (uint64, error) {
+	return h.handler.GetMessageCount()
+}
+
+func (h *handlerAdapter) GetMessageID(ctx context.Context, number uint64) (string, error) {
+	return h.handler.GetMessageID(number)
+}
+
+func (h *handlerAdapter) GetMessageSize(ctx context.Context, number uint64) (uint64, error) {
+	return h.handler.GetMessageSize(number)
+}
+
+func (h *handlerAdapter) HandleSessionError(ctx context.Context, err error) {
+	h.handler.HandleSessionError(err)
+}
+
+func (h *handlerAdapter) LockMaildrop(ctx context.Context) error {
+	return h.handler.LockMaildrop()
+}
+
+func (h *handlerAdapter) SetBanner(ctx context.Context, banner string) error {
+	return h.handler.SetBanner(banner)
+}
+
+func (h *handlerAdapter) UnlockMaildrop(ctx context.Context) error {
+	return h.handler.UnlockMaildrop()
+}
+
+func (h *handlerAdapter) unwrap() interface{} {
+	return h.handler
+}
+
+// unwrapper is implemented by adapters which wrap objects that may implement
+// optional handler interfaces.
+type unwrapper interface {
+	unwrap() interface{}
+}
+
+// unwrapHandler returns the object optional handler interfaces (e.g.
+// APOPSecretProvider) should be looked up on.
+func unwrapHandler(handler ContextHandler) interface{} {
+	if u, ok := handler.(unwrapper); ok {
+		return u.unwrap()
+	}
+	return handler
+}
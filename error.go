@@ -4,21 +4,71 @@ import (
 	"fmt"
 )
 
+// ResponseCode is an extended response code which may accompany a negative
+// response to give the client a hint about the nature of the failure.
+// RFC 2449, page 8.
+type ResponseCode string
+
+const (
+	// CodeInUse means that the maildrop is already locked by another
+	// session. RFC 2449, page 8.
+	CodeInUse ResponseCode = "IN-USE"
+
+	// CodeLoginDelay means that the user is trying to log in again too
+	// early. RFC 2449, page 8.
+	CodeLoginDelay ResponseCode = "LOGIN-DELAY"
+
+	// CodeSysTemp means that the failure is caused by a temporary problem
+	// on the server side. RFC 3206, page 3.
+	CodeSysTemp ResponseCode = "SYS/TEMP"
+
+	// CodeSysPerm means that the failure is caused by a permanent problem
+	// on the server side. RFC 3206, page 3.
+	CodeSysPerm ResponseCode = "SYS/PERM"
+
+	// CodeAuth means that the authentication failed because of the user's
+	// credentials. RFC 3206, page 3.
+	CodeAuth ResponseCode = "AUTH"
+)
+
+// ErrMaildropInUse can be returned from LockMaildrop to let the client know
+// that the maildrop is locked by another session.
+var ErrMaildropInUse = NewCodedError(CodeInUse, "maildrop already locked")
+
 // ReportableError is a trivial implementation of 'error' interface but it is
 // useful for deciding which errors can be reported to the POP3 client and
 // which are internal-only.
 type ReportableError struct {
+	code    ResponseCode
 	message string
 }
 
 // NewReportableError provides a helper function for creating instances of
 // ReportableError.
 func NewReportableError(format string, args ...interface{}) error {
+	return NewCodedError("", format, args...)
+}
+
+// NewCodedError provides a helper function for creating instances of
+// ReportableError carrying an extended response code.
+func NewCodedError(code ResponseCode, format string, args ...interface{}) error {
 	return &ReportableError{
+		code:    code,
 		message: fmt.Sprintf(format, args...),
 	}
 }
 
+// Code returns the extended response code of the error, or an empty string if
+// there is none.
+func (r *ReportableError) Code() ResponseCode {
+	return r.code
+}
+
+// Error returns the message the way it is presented to the client, that is
+// preceded by the response code in square brackets if there is one.
 func (r *ReportableError) Error() string {
-	return r.message
+	if r.code == "" {
+		return r.message
+	}
+	return fmt.Sprintf("[%s] %s", r.code, r.message)
 }
@@ -1,6 +1,8 @@
 package popart
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
 )
 
@@ -19,7 +21,8 @@ type Handler interface {
 	// client generates an md5 hexdigest based on a shared secret and the
 	// banner displayed by the server at the beginning of the connection.
 	// As per RFC1939 a server MUST support at least one authentication
-	// mechanism but does not need to support any particular one.
+	// mechanism but does not need to support any particular one. This
+	// method is not called if the handler implements APOPSecretProvider.
 	AuthenticateAPOP(username, hexdigest string) error
 
 	// DeleteMessage takes a list of ordinal number of messages in a user's
@@ -47,7 +50,8 @@ type Handler interface {
 	// GetMessageCount takes an ordinal number of a message in a users's
 	// maildrop and returns its size in bytes. This may differ from what is
 	// eventually returned to the client because of line ending replacements
-	// and dot escapes but it should be reasonably close nevertheless.
+	// and dot escapes but it should be reasonably close nevertheless. If
+	// exact sizes are required, see the Server's ExactSizes setting.
 	GetMessageSize(number uint64) (uint64, error)
 
 	// HandleSessionError would be invoked if the code *outside* of the
@@ -59,13 +63,15 @@ type Handler interface {
 	// any concurrent sessions that attempt to communicate with the server
 	// should fail until the current session calls UnlockMaildrop. This
 	// method should return an error if it is not possible to lock the
-	// maildrop.
+	// maildrop. ErrMaildropInUse lets the client know that the maildrop is
+	// locked by another session.
 	LockMaildrop() error
 
 	// SetBanner is called by APOP-enabled servers at the beginning of the
 	// session. It is expected that the banner is stored somewhere since it
 	// is expected that it will be available for proper handling of the
-	// AuthenticateAPOP call.
+	// AuthenticateAPOP call. Handlers implementing APOPSecretProvider do not
+	// need to store the banner.
 	SetBanner(banner string) error
 
 	// UnlockMaildrop releases global maildrop lock so that other clients
@@ -74,3 +80,140 @@ type Handler interface {
 	// circumstances.
 	UnlockMaildrop() error
 }
+
+// ContextHandler is a variant of Handler whose methods take a context bound
+// to the POP3 session. The context carries the address of the client and the
+// ID of the session (see PeerAddrFromContext and SessionIDFromContext) and is
+// cancelled once the session ends for whatever reason - the client
+// disconnecting or timing out, the session being terminated with the Server's
+// TerminateSession method or the server being closed - as well as when the
+// Server's Shutdown runs out of time. The semantics of all methods are the same
+// as those of their Handler counterparts.
+//
+// The client disconnecting is noticed while a handler method is running too,
+// so that the handler can give up on expensive work (e.g. in GetMessageReader).
+// The exceptions are AUTH and STLS commands which read from the client
+// themselves, and QUIT whose deletions must be carried out even if the client
+// does not wait for the response. The same context is passed to methods of
+// optional interfaces, like Authorizer or MaildropLister.
+//
+// The contexts passed to HandleSessionError and UnlockMaildrop are never
+// cancelled since they are generally called after the session has ended.
+type ContextHandler interface {
+	AuthenticatePASS(ctx context.Context, username, password string) error
+	AuthenticateAPOP(ctx context.Context, username, hexdigest string) error
+	DeleteMessages(ctx context.Context, numbers []uint64) error
+	GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error)
+	GetMessageCount(ctx context.Context) (uint64, error)
+	GetMessageID(ctx context.Context, number uint64) (string, error)
+	GetMessageSize(ctx context.Context, number uint64) (uint64, error)
+	HandleSessionError(ctx context.Context, err error)
+	LockMaildrop(ctx context.Context) error
+	SetBanner(ctx context.Context, banner string) error
+	UnlockMaildrop(ctx context.Context) error
+}
+
+// Authorizer is an optional interface for handlers which let the server verify
+// user credentials on their behalf (e.g. with SCRAM mechanisms) instead of
+// doing it themselves.
+type Authorizer interface {
+	// Authorize is called once the server has successfully verified the
+	// credentials of the user. Much like after AuthenticatePASS, it is
+	// expected that the handler will associate all subsequent operations
+	// with this particular user.
+	Authorize(ctx context.Context, username string) error
+}
+
+// SCRAMCredentialsProvider is an optional interface for handlers which want
+// to support SCRAM SASL mechanisms (RFC 5802) without storing reversible
+// secrets.
+type SCRAMCredentialsProvider interface {
+	Authorizer
+
+	// GetSCRAMCredentials takes the name of a hash function ("SHA-1" or
+	// "SHA-256") and a username and returns the user's salted password
+	// (the result of the Hi function from RFC 5802) along with the salt
+	// and iteration count used to calculate it.
+	GetSCRAMCredentials(ctx context.Context, hash, username string) (saltedPassword, salt []byte, iterations int, err error)
+}
+
+// CRAMSecretProvider is an optional interface for handlers which want to
+// support the CRAM-MD5 SASL mechanism (RFC 2195).
+type CRAMSecretProvider interface {
+	Authorizer
+
+	// GetCRAMSecret returns the secret shared between the server and the
+	// user. The server uses it to verify the keyed digest sent by the
+	// client.
+	GetCRAMSecret(ctx context.Context, username string) (string, error)
+}
+
+// TokenAuthenticator is an optional interface for handlers which want to
+// support OAUTHBEARER (RFC 7628) and XOAUTH2 SASL mechanisms.
+type TokenAuthenticator interface {
+	// AuthenticateToken takes an OAuth 2.0 bearer token along with the
+	// name of the user provided by the client, which may be empty, and
+	// returns the name of the user the token belongs to. Should the
+	// validation fail it is expected to return a ReportableError. Much like
+	// after AuthenticatePASS, it is expected that the handler will
+	// associate all subsequent operations with this particular user.
+	AuthenticateToken(ctx context.Context, username, token string) (string, error)
+}
+
+// CertificateAuthenticator is an optional interface for handlers which want
+// to support the EXTERNAL SASL mechanism with TLS client certificates.
+type CertificateAuthenticator interface {
+	// AuthenticateCertificate takes the authorization identity requested by
+	// the client, which may be empty, and the verified certificate chain
+	// presented by the client, starting with the leaf certificate. It
+	// returns the name of the user the certificate maps to or a
+	// ReportableError if it does not map to any or is not allowed to act
+	// as the requested user. Much like after AuthenticatePASS, it is
+	// expected that the handler will associate all subsequent operations
+	// with this particular user.
+	AuthenticateCertificate(ctx context.Context, authzID string, chain []*x509.Certificate) (string, error)
+}
+
+// APOPSecretProvider is an optional interface for handlers which want the
+// server to verify APOP digests on their behalf.
+type APOPSecretProvider interface {
+	Authorizer
+
+	// GetAPOPSecret returns the secret shared between the server and the
+	// user. The server uses it along with the banner to calculate the
+	// expected digest and compares it with the one sent by the client.
+	GetAPOPSecret(ctx context.Context, username string) (string, error)
+}
+
+// MaildropLister is an optional interface for handlers (or Mailboxes) which
+// can list the whole maildrop at once. If implemented, it is used instead of
+// calling GetMessageCount and then GetMessageSize for every single message
+// when the user logs in.
+type MaildropLister interface {
+	// ListMessages returns sizes of all messages in the maildrop, ordered
+	// by their ordinal numbers. It may also return their unique IDs in the
+	// same order, in which case they are used instead of calling
+	// GetMessageID. Otherwise ids should be nil.
+	ListMessages(ctx context.Context) (sizes []uint64, ids []string, err error)
+}
+
+// ExactSizer is an optional interface for handlers (or Mailboxes) which know
+// exact sizes of messages as they are sent to the client. It is only used if
+// the Server's ExactSizes setting is enabled.
+type ExactSizer interface {
+	// GetExactMessageSize returns the size of a message with all line
+	// endings converted to CRLF and a final CRLF appended if missing,
+	// without counting dot escapes.
+	GetExactMessageSize(ctx context.Context, number uint64) (uint64, error)
+}
+
+// CapabilityProvider is an optional interface for handlers (or Mailboxes)
+// which announce different capabilities to different users, e.g. a per-user
+// EXPIRE or LOGIN-DELAY policy. RFC 2449, page 3.
+type CapabilityProvider interface {
+	// Capabilities is called when an authenticated client issues the CAPA
+	// command. It receives capabilities the server would announce on its
+	// own and returns the ones to actually announce, so it can add new
+	// ones as well as replace or remove the existing ones.
+	Capabilities(ctx context.Context, capabilities []string) ([]string, error)
+}
@@ -0,0 +1,83 @@
+package popart
+
+import (
+	"net"
+	"time"
+)
+
+// rejectWriteTimeout limits how long the server tries to tell a rejected
+// client why it is being disconnected.
+const rejectWriteTimeout = 10 * time.Second
+
+var (
+	// ErrTooManySessions is the reason for rejecting a connection when
+	// the server already handles MaxSessions sessions.
+	ErrTooManySessions = NewCodedError(CodeSysTemp, "too many sessions, try again later")
+
+	// ErrTooManyPeerSessions is the reason for rejecting a connection when
+	// the server already handles MaxSessionsPerIP sessions from the same
+	// IP address.
+	ErrTooManyPeerSessions = NewCodedError(CodeSysTemp, "too many sessions from your address, try again later")
+)
+
+// admit reserves a slot for a new connection, unless that would exceed one
+// of the concurrency limits. The slot must be returned with release.
+func (s *Server) admit(peer net.Addr) error {
+	ip := peerIP(peer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxSessions > 0 && s.connections >= s.MaxSessions {
+		return ErrTooManySessions
+	}
+	if s.MaxSessionsPerIP > 0 && s.peerConnections[ip] >= s.MaxSessionsPerIP {
+		return ErrTooManyPeerSessions
+	}
+	if s.peerConnections == nil {
+		s.peerConnections = make(map[string]int)
+	}
+	s.connections++
+	s.peerConnections[ip]++
+	return nil
+}
+
+// release returns the slot reserved with admit.
+func (s *Server) release(peer net.Addr) {
+	ip := peerIP(peer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connections--
+	if s.peerConnections[ip]--; s.peerConnections[ip] <= 0 {
+		delete(s.peerConnections, ip)
+	}
+}
+
+// activeConnections returns the number of connections admitted by the server
+// which are still open, including those still waiting for their handlers.
+func (s *Server) activeConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// reject sends the client a negative greeting explaining the reason for
+// rejecting the connection and closes it.
+func (s *Server) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+	if s.OnConnectionRejected != nil {
+		s.OnConnectionRejected(conn.RemoteAddr(), reason)
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout)); err != nil {
+		return
+	}
+	conn.Write([]byte("-ERR " + reason.Error() + "\r\n"))
+}
+
+// peerIP returns the IP address of the peer, or the whole address if it does
+// not contain a port.
+func peerIP(peer net.Addr) string {
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return peer.String()
+	}
+	return host
+}
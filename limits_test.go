@@ -0,0 +1,109 @@
+package popart
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection pretending to come from a given address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// dialFrom connects to the server as if from the given address.
+func (l *pipeListener) dialFrom(t *testing.T, addr string) *testClient {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- &addrConn{Conn: server, remote: pipeAddr(addr)}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not accept the connection")
+	}
+	return newTestClient(t, client)
+}
+
+// rejections records connections rejected by the server.
+type rejections struct {
+	mu      sync.Mutex
+	reasons []error
+}
+
+func (r *rejections) record(peer net.Addr, reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasons = append(r.reasons, reason)
+}
+
+func (r *rejections) list() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error{}, r.reasons...)
+}
+
+func TestMaxSessions(t *testing.T) {
+	rejected := &rejections{}
+	srv := &Server{
+		Backend:              newTestBackend(),
+		MaxSessions:          2,
+		OnConnectionRejected: rejected.record,
+	}
+	listener := serveTest(t, srv)
+	first := listener.dialFrom(t, "192.0.2.1:1000")
+	first.line()
+	second := listener.dialFrom(t, "192.0.2.2:1000")
+	second.line()
+
+	refused := listener.dialFrom(t, "192.0.2.3:1000")
+	if line := refused.line(); line != "-ERR "+ErrTooManySessions.Error() {
+		t.Errorf("got %q, expected the connection to be refused", line)
+	}
+	refused.expectClosed()
+	if reasons := rejected.list(); len(reasons) != 1 || reasons[0] != ErrTooManySessions {
+		t.Errorf("got rejections %v, expected ErrTooManySessions", reasons)
+	}
+
+	first.expect("+OK", "QUIT")
+	first.expectClosed()
+	waitFor(t, "the session to end", func() bool { return srv.activeConnections() == 1 })
+	third := listener.dialFrom(t, "192.0.2.3:1000")
+	if line := third.line(); !strings.HasPrefix(line, "+OK") {
+		t.Errorf("got %q, expected the connection to be accepted", line)
+	}
+}
+
+func TestMaxSessionsPerIP(t *testing.T) {
+	rejected := &rejections{}
+	srv := &Server{
+		Backend:              newTestBackend(),
+		MaxSessionsPerIP:     1,
+		OnConnectionRejected: rejected.record,
+	}
+	listener := serveTest(t, srv)
+	first := listener.dialFrom(t, "192.0.2.1:1000")
+	first.line()
+	other := listener.dialFrom(t, "192.0.2.2:1000")
+	other.line()
+
+	refused := listener.dialFrom(t, "192.0.2.1:2000")
+	if line := refused.line(); line != "-ERR "+ErrTooManyPeerSessions.Error() {
+		t.Errorf("got %q, expected the connection to be refused", line)
+	}
+	refused.expectClosed()
+	if reasons := rejected.list(); len(reasons) != 1 || reasons[0] != ErrTooManyPeerSessions {
+		t.Errorf("got rejections %v, expected ErrTooManyPeerSessions", reasons)
+	}
+
+	first.conn.Close()
+	waitFor(t, "the session to end", func() bool { return srv.activeConnections() == 1 })
+	again := listener.dialFrom(t, "192.0.2.1:2000")
+	if line := again.line(); !strings.HasPrefix(line, "+OK") {
+		t.Errorf("got %q, expected the connection to be accepted", line)
+	}
+}
@@ -0,0 +1,299 @@
+package popart
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expireNever is the parsed value of the "NEVER" EXPIRE policy.
+const expireNever = -1
+
+// UserStateStore keeps track of per-user state needed to enforce the EXPIRE
+// and LOGIN-DELAY policies across sessions. It must be safe for concurrent
+// use by multiple sessions.
+type UserStateStore interface {
+	// LastLogin returns the time of the user's previous successful login,
+	// or zero time if there was none.
+	LastLogin(ctx context.Context, username string) (time.Time, error)
+
+	// RecordLogin records a successful login of the user.
+	RecordLogin(ctx context.Context, username string, at time.Time) error
+
+	// RecordRetrievals records that messages with the given unique IDs
+	// have been retrieved at the given time. Messages retrieved before
+	// should keep their original retrieval time.
+	RecordRetrievals(ctx context.Context, username string, ids []string, at time.Time) error
+
+	// RetrievedBefore returns unique IDs of the user's messages which have
+	// been retrieved before the given time.
+	RetrievedBefore(ctx context.Context, username string, before time.Time) ([]string, error)
+
+	// ForgetMessages is called once messages with the given unique IDs
+	// have been deleted so that their state can be discarded.
+	ForgetMessages(ctx context.Context, username string, ids []string) error
+}
+
+// RetrievalTracker is an optional interface for handlers (or Mailboxes) which
+// keep track of message retrievals themselves, e.g. along with the messages.
+// If implemented, it is used to enforce the EXPIRE policy instead of the
+// Server's UserStates.
+type RetrievalTracker interface {
+	// RecordRetrievals records that messages with the given unique IDs
+	// have been retrieved at the given time. Messages retrieved before
+	// should keep their original retrieval time.
+	RecordRetrievals(ctx context.Context, ids []string, at time.Time) error
+
+	// RetrievedBefore returns unique IDs of messages which have been
+	// retrieved before the given time.
+	RetrievedBefore(ctx context.Context, before time.Time) ([]string, error)
+}
+
+// NewMemoryUserStateStore returns a UserStateStore which keeps all the state
+// in memory, so it is lost when the process exits.
+func NewMemoryUserStateStore() UserStateStore {
+	return &memoryUserStates{
+		logins:     make(map[string]time.Time),
+		retrievals: make(map[string]map[string]time.Time),
+	}
+}
+
+type memoryUserStates struct {
+	mu         sync.Mutex
+	logins     map[string]time.Time
+	retrievals map[string]map[string]time.Time
+}
+
+func (m *memoryUserStates) LastLogin(ctx context.Context, username string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logins[username], nil
+}
+
+func (m *memoryUserStates) RecordLogin(ctx context.Context, username string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logins[username] = at
+	return nil
+}
+
+func (m *memoryUserStates) RecordRetrievals(ctx context.Context, username string, ids []string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	retrievals, exists := m.retrievals[username]
+	if !exists {
+		retrievals = make(map[string]time.Time)
+		m.retrievals[username] = retrievals
+	}
+	for _, id := range ids {
+		if _, seen := retrievals[id]; !seen {
+			retrievals[id] = at
+		}
+	}
+	return nil
+}
+
+func (m *memoryUserStates) RetrievedBefore(ctx context.Context, username string, before time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ret []string
+	for id, at := range m.retrievals[username] {
+		if at.Before(before) {
+			ret = append(ret, id)
+		}
+	}
+	return ret, nil
+}
+
+func (m *memoryUserStates) ForgetMessages(ctx context.Context, username string, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	retrievals := m.retrievals[username]
+	for _, id := range ids {
+		delete(retrievals, id)
+	}
+	if len(retrievals) == 0 {
+		delete(m.retrievals, username)
+	}
+	return nil
+}
+
+// storeTracker makes a UserStateStore usable as a RetrievalTracker for a
+// single user.
+type storeTracker struct {
+	store    UserStateStore
+	username string
+}
+
+func (t *storeTracker) RecordRetrievals(ctx context.Context, ids []string, at time.Time) error {
+	return t.store.RecordRetrievals(ctx, t.username, ids, at)
+}
+
+func (t *storeTracker) RetrievedBefore(ctx context.Context, before time.Time) ([]string, error) {
+	return t.store.RetrievedBefore(ctx, t.username, before)
+}
+
+func (t *storeTracker) forgetMessages(ctx context.Context, ids []string) error {
+	return t.store.ForgetMessages(ctx, t.username, ids)
+}
+
+// parseExpire parses the EXPIRE policy, which is either "NEVER" or a number of
+// days, optionally followed by "USER" to let the client know that the policy
+// differs between users.
+// RFC 2449, page 6.
+func parseExpire(expire string) (int, error) {
+	fields := strings.Fields(expire)
+	if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "USER") {
+		return 0, fmt.Errorf("invalid EXPIRE policy: %q", expire)
+	}
+	if fields[0] == "NEVER" {
+		return expireNever, nil
+	}
+	days, err := strconv.Atoi(fields[0])
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("invalid EXPIRE policy: %q", expire)
+	}
+	return days, nil
+}
+
+// checkLoginDelay refuses the login if the user's previous one happened less
+// than LoginDelay ago.
+// RFC 2449, page 8.
+func (s *session) checkLoginDelay() error {
+	if s.server.LoginDelay <= 0 {
+		return nil
+	}
+	last, err := s.server.UserStates.LastLogin(s.ctx, s.username)
+	if err != nil {
+		return err
+	}
+	if !last.IsZero() && time.Since(last) < s.server.LoginDelay {
+		return NewCodedError(
+			CodeLoginDelay,
+			"minimum time between logins is %d seconds",
+			int(s.server.LoginDelay/time.Second),
+		)
+	}
+	return nil
+}
+
+// recordLogin stores the time of the login if the LOGIN-DELAY policy is
+// enforced.
+func (s *session) recordLogin() error {
+	if s.server.LoginDelay <= 0 {
+		return nil
+	}
+	return s.server.UserStates.RecordLogin(s.ctx, s.username, time.Now())
+}
+
+// retrievalTracker returns the tracker used to enforce the EXPIRE policy,
+// preferring the one provided by the handler.
+func (s *session) retrievalTracker() RetrievalTracker {
+	if tracker, ok := unwrapHandler(s.handler).(RetrievalTracker); ok {
+		return tracker
+	}
+	return &storeTracker{store: s.server.UserStates, username: s.username}
+}
+
+// expireMessages hides messages retrieved more than EXPIRE days ago. They are
+// treated as if the client marked them as deleted, except that RSET does not
+// bring them back.
+func (s *session) expireMessages() error {
+	if s.server.expireDays <= 0 {
+		return nil
+	}
+	before := time.Now().AddDate(0, 0, -s.server.expireDays)
+	ids, err := s.retrievalTracker().RetrievedBefore(s.ctx, before)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	expiredIDs := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		expiredIDs[id] = struct{}{}
+	}
+	for msgID := range s.msgSizes {
+		id, err := s.getMessageID(msgID)
+		if err != nil {
+			return err
+		}
+		if _, isExpired := expiredIDs[id]; isExpired {
+			s.expired[msgID] = struct{}{}
+			s.markedDeleted[msgID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// messagesToDelete returns messages marked as deleted along with the ones
+// which the EXPIRE policy requires to be deleted at the end of the session.
+func (s *session) messagesToDelete() []uint64 {
+	var ret []uint64
+	for msgID := range s.markedDeleted {
+		ret = append(ret, msgID)
+	}
+	if s.server.expireDays != 0 {
+		return ret
+	}
+	for msgID := range s.retrieved {
+		if _, isDeleted := s.markedDeleted[msgID]; !isDeleted {
+			ret = append(ret, msgID)
+		}
+	}
+	return ret
+}
+
+// updateIDs resolves unique IDs of messages about to be deleted and of the
+// ones retrieved but kept, as far as they are needed once the handler deletes
+// messages. It must be called before DeleteMessages since the handler may
+// renumber the remaining messages afterwards.
+func (s *session) updateIDs(deleted []uint64) (deletedIDs, retrievedIDs []string, err error) {
+	if s.server.expireDays > 0 || s.storesSizes() {
+		if deletedIDs, err = s.messageIDs(deleted); err != nil {
+			return nil, nil, err
+		}
+	}
+	if s.server.expireDays <= 0 {
+		return deletedIDs, nil, nil
+	}
+	var retrieved []uint64
+	for msgID := range s.retrieved {
+		if _, isDeleted := s.markedDeleted[msgID]; !isDeleted {
+			retrieved = append(retrieved, msgID)
+		}
+	}
+	retrievedIDs, err = s.messageIDs(retrieved)
+	return deletedIDs, retrievedIDs, err
+}
+
+// updateRetrievals lets the tracker know which messages have been retrieved
+// and which have been deleted during the session.
+func (s *session) updateRetrievals(deletedIDs, retrievedIDs []string) error {
+	if s.server.expireDays <= 0 {
+		return nil
+	}
+	tracker := s.retrievalTracker()
+	if forgetter, ok := tracker.(*storeTracker); ok && len(deletedIDs) > 0 {
+		if err := forgetter.forgetMessages(s.ctx, deletedIDs); err != nil {
+			return err
+		}
+	}
+	if len(retrievedIDs) == 0 {
+		return nil
+	}
+	return tracker.RecordRetrievals(s.ctx, retrievedIDs, time.Now())
+}
+
+func (s *session) messageIDs(msgIDs []uint64) ([]string, error) {
+	ret := make([]string, 0, len(msgIDs))
+	for _, msgID := range msgIDs {
+		id, err := s.getMessageID(msgID)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
@@ -0,0 +1,203 @@
+package popart
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// renumberingMailbox removes deleted messages right away, renumbering the
+// remaining ones like most real message stores do.
+type renumberingMailbox struct {
+	mu   sync.Mutex
+	ids  []string
+	msgs []string
+}
+
+func (m *renumberingMailbox) Lock(ctx context.Context) error   { return nil }
+func (m *renumberingMailbox) Unlock(ctx context.Context) error { return nil }
+
+func (m *renumberingMailbox) DeleteMessages(ctx context.Context, numbers []uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := make(map[uint64]bool)
+	for _, number := range numbers {
+		deleted[number] = true
+	}
+	var ids, msgs []string
+	for i := range m.ids {
+		if !deleted[uint64(i+1)] {
+			ids, msgs = append(ids, m.ids[i]), append(msgs, m.msgs[i])
+		}
+	}
+	m.ids, m.msgs = ids, msgs
+	return nil
+}
+
+func (m *renumberingMailbox) GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ioutil.NopCloser(strings.NewReader(m.msgs[number-1])), nil
+}
+
+func (m *renumberingMailbox) GetMessageCount(ctx context.Context) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.ids)), nil
+}
+
+func (m *renumberingMailbox) GetMessageID(ctx context.Context, number uint64) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[number-1], nil
+}
+
+func (m *renumberingMailbox) GetMessageSize(ctx context.Context, number uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return uint64(len(m.msgs[number-1])), nil
+}
+
+type renumberingBackend struct {
+	*testBackend
+	mailbox *renumberingMailbox
+}
+
+func (b *renumberingBackend) Login(ctx context.Context, username, password string) (Mailbox, error) {
+	if _, err := b.testBackend.Login(ctx, username, password); err != nil {
+		return nil, err
+	}
+	return b.mailbox, nil
+}
+
+func retrievedIDs(t *testing.T, store UserStateStore) []string {
+	t.Helper()
+	ids, err := store.RetrievedBefore(context.Background(), "alice", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestParseExpire(t *testing.T) {
+	for expire, expected := range map[string]int{
+		"NEVER":      expireNever,
+		"NEVER USER": expireNever,
+		"0":          0,
+		"30":         30,
+		"30 USER":    30,
+	} {
+		if days, err := parseExpire(expire); err != nil || days != expected {
+			t.Errorf("parseExpire(%q) = %d, %v; expected %d", expire, days, err, expected)
+		}
+	}
+	for _, expire := range []string{"", "never", "-1", "30 DAYS", "30 USER X", "3O"} {
+		if _, err := parseExpire(expire); err == nil {
+			t.Errorf("parseExpire(%q) did not fail", expire)
+		}
+	}
+}
+
+func TestExpireZeroDeletesRetrievedMessages(t *testing.T) {
+	backend := newTestBackend("a\r\n", "b\r\n", "c\r\n")
+	listener := serveTest(t, &Server{Backend: backend, Expire: "0"})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "RETR 2")
+	client.lines()
+	client.expect("+OK", "TOP 3 0")
+	client.lines()
+	client.expect("+OK", "QUIT")
+	client.expectClosed()
+	if deleted := backend.mailbox.deleted; !reflect.DeepEqual(deleted, []uint64{2}) {
+		t.Errorf("deleted messages %v, expected [2]", deleted)
+	}
+}
+
+func TestExpireHidesMessagesRetrievedLongAgo(t *testing.T) {
+	store := NewMemoryUserStateStore()
+	longAgo := time.Now().AddDate(0, 0, -31)
+	if err := store.RecordRetrievals(context.Background(), "alice", []string{"x"}, longAgo); err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestBackend("a\r\n", "bc\r\n")
+	listener := serveTest(t, &Server{Backend: backend, Expire: "30", UserStates: store})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK 1 4", "STAT")
+	client.expect("-ERR", "RETR 1")
+	client.expect("+OK", "RSET")
+	client.expect("+OK 1 4", "STAT")
+	client.expect("+OK", "RETR 2")
+	client.lines()
+	client.expect("+OK", "QUIT")
+	client.expectClosed()
+
+	if deleted := backend.mailbox.deleted; !reflect.DeepEqual(deleted, []uint64{1}) {
+		t.Errorf("deleted messages %v, expected [1]", deleted)
+	}
+	if ids := retrievedIDs(t, store); !reflect.DeepEqual(ids, []string{"xx"}) {
+		t.Errorf("retrieved messages %v, expected [xx]", ids)
+	}
+}
+
+func TestExpireTracksMessagesRenumberedByDeletion(t *testing.T) {
+	store := NewMemoryUserStateStore()
+	ctx := context.Background()
+	if err := store.RecordRetrievals(ctx, "alice", []string{"A"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	backend := &renumberingBackend{
+		testBackend: newTestBackend(),
+		mailbox: &renumberingMailbox{
+			ids:  []string{"A", "B", "C"},
+			msgs: []string{"a\r\n", "b\r\n", "c\r\n"},
+		},
+	}
+	listener := serveTest(t, &Server{Backend: backend, Expire: "30", UserStates: store})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "DELE 1")
+	client.expect("+OK", "RETR 2")
+	client.lines()
+	client.expect("+OK", "QUIT")
+	client.expectClosed()
+
+	if ids := retrievedIDs(t, store); !reflect.DeepEqual(ids, []string{"B"}) {
+		t.Errorf("retrieved messages %v, expected [B]", ids)
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	listener := serveTest(t, &Server{Backend: newTestBackend(), LoginDelay: time.Hour})
+	client := listener.dial(t)
+	client.line()
+	client.expect("+OK", "CAPA")
+	if lines := client.lines(); !contains(lines, "LOGIN-DELAY 3600") {
+		t.Errorf("LOGIN-DELAY not announced: %q", lines)
+	}
+	client.expect("+OK", "USER alice")
+	client.expect("+OK", "PASS secret")
+	client.expect("+OK", "QUIT")
+
+	client = listener.dial(t)
+	client.line()
+	client.expect("+OK", "USER alice")
+	client.expect("-ERR [LOGIN-DELAY]", "PASS secret")
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
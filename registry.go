@@ -0,0 +1,104 @@
+package popart
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionNotFound is returned by the Server's TerminateSession method if
+// there is no active session with the requested ID.
+var ErrSessionNotFound = errors.New("popart: session not found")
+
+// SessionInfo is a read-only snapshot of a single active POP3 session.
+type SessionInfo struct {
+	// ID uniquely identifies the session within the Server.
+	ID uint64
+
+	// RemoteAddr is the address of the POP3 client.
+	RemoteAddr net.Addr
+
+	// Username is the name of the authenticated user. It is empty until
+	// the client successfully authenticates.
+	Username string
+
+	// State is the name of the POP3 session state as per RFC 1939, i.e.
+	// AUTHORIZATION, TRANSACTION or UPDATE.
+	State string
+
+	// Started is when the client connected to the server.
+	Started time.Time
+
+	// Command is the name of the command currently being processed or an
+	// empty string if the session is waiting for the client.
+	Command string
+
+	// BytesSent is the number of bytes sent to the client so far, not
+	// counting TLS overhead.
+	BytesSent uint64
+}
+
+// Sessions returns a snapshot of all active sessions ordered by their IDs.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	ret := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		ret = append(ret, sess.info())
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// TerminateSession forcibly closes the client connection of the session with
+// a given ID. The session will still unlock the user's maildrop, if locked,
+// but TerminateSession does not wait for that to happen.
+func (s *Server) TerminateSession(id uint64) error {
+	s.mu.Lock()
+	sess, exists := s.sessions[id]
+	s.mu.Unlock()
+	if !exists {
+		return ErrSessionNotFound
+	}
+	sess.terminate()
+	return nil
+}
+
+// trackSession adds a new session to the set of active ones. It returns false
+// if the server is already shutting down.
+func (s *Server) trackSession(sess *session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	s.sessions[sess.id] = sess
+	return true
+}
+
+// untrackSession removes a finished session from the set of active ones and
+// releases its connection slot.
+func (s *Server) untrackSession(sess *session) {
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+	s.release(sess.rawConn.RemoteAddr())
+}
+
+// countingWriter counts bytes written to the underlying io.Writer.
+type countingWriter struct {
+	writer io.Writer
+	count  *uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
@@ -0,0 +1,59 @@
+package popart
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSessionsAndTerminateSession(t *testing.T) {
+	backend := newTestBackend("hello\r\n")
+	srv := &Server{Backend: backend}
+	listener := serveTest(t, srv)
+	other := listener.dial(t)
+	other.line()
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "NOOP")
+
+	var sessions []SessionInfo
+	waitFor(t, "NOOP to finish", func() bool {
+		sessions = srv.Sessions()
+		return len(sessions) == 2 && sessions[1].Command == ""
+	})
+	if sessions[0].ID >= sessions[1].ID {
+		t.Errorf("sessions not ordered by ID: %d, %d", sessions[0].ID, sessions[1].ID)
+	}
+	info := sessions[1]
+	if info.Username != "alice" || info.State != "TRANSACTION" || info.BytesSent == 0 {
+		t.Errorf("unexpected session info: %+v", info)
+	}
+	if sessions[0].Username != "" || sessions[0].State != "AUTHORIZATION" {
+		t.Errorf("unexpected session info: %+v", sessions[0])
+	}
+
+	if err := srv.TerminateSession(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	client.expectClosed()
+	waitFor(t, "the session to end", func() bool { return len(srv.Sessions()) == 1 })
+	if _, unlocks := backend.mailbox.lockCounts(); unlocks != 1 {
+		t.Errorf("got %d unlocks, expected 1", unlocks)
+	}
+	if err := srv.TerminateSession(info.ID); err != ErrSessionNotFound {
+		t.Errorf("terminating a finished session returned %v", err)
+	}
+	other.expect("+OK", "USER bob")
+}
+
+func TestTerminatingSessionKeepsItsState(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	sess := newSession(&Server{}, server)
+	sess.username = "bob" // given with USER but not authenticated
+	sess.publishStatus("QUIT")
+	sess.state = stateTerminateConnection
+	sess.publishStatus("")
+	if info := sess.info(); info.State != "AUTHORIZATION" || info.Username != "" {
+		t.Errorf("got state %q and username %q, expected AUTHORIZATION and none", info.State, info.Username)
+	}
+}
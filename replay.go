@@ -0,0 +1,40 @@
+package popart
+
+import (
+	"sync"
+	"time"
+)
+
+var errAPOPReplayed = NewCodedError(CodeAuth, "APOP digest already used")
+
+// replayCache remembers recently used authentication tokens (e.g. APOP
+// digests) so that they can not be used again within a given time window.
+type replayCache struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// check records the use of a token and reports whether it has already been
+// used within the time window.
+func (r *replayCache) check(token string) bool {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, usedAt := range r.seen {
+		if now.Sub(usedAt) >= r.window {
+			delete(r.seen, key)
+		}
+	}
+	_, replayed := r.seen[token]
+	r.seen[token] = now
+	return replayed
+}
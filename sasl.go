@@ -0,0 +1,231 @@
+package popart
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"sort"
+	"strings"
+)
+
+var (
+	errAuthCancelled      = NewReportableError("authentication cancelled")
+	errInvalidEncoding    = NewReportableError("invalid base64 encoding")
+	errUnknownMechanism   = NewReportableError("unsupported authentication mechanism")
+	errUnexpectedResponse = NewReportableError("unexpected client response")
+)
+
+// SASLServer is the server side of a single SASL (RFC 4422) authentication
+// exchange. A new one is created for every AUTH command.
+type SASLServer interface {
+	// Next takes the client's response and returns the next challenge to
+	// be sent to the client. The first call receives the initial response
+	// or nil if the client did not provide one. Once the exchange completes
+	// successfully Next should set done, in which case a non-nil challenge
+	// is treated as additional data with success. Returning a
+	// ReportableError aborts the exchange with an error message sent to
+	// the client while any other error terminates the session.
+	Next(response []byte) (challenge []byte, done bool, err error)
+
+	// Username returns the name of the user authenticated by the exchange.
+	// It will only be called after Next reported successful completion.
+	Username() string
+}
+
+// SASLMechanism is a factory of SASLServer objects for a single named SASL
+// mechanism.
+type SASLMechanism interface {
+	// Available reports whether the mechanism can be offered to the
+	// client on a given connection. Mechanisms which are not available are
+	// not announced in response to the CAPA command and can not be used.
+	Available(conn *SASLConn) bool
+
+	// Start begins a new authentication exchange.
+	Start(conn *SASLConn) (SASLServer, error)
+}
+
+// SASLConn describes the POP3 session within which a SASL exchange is taking
+// place.
+type SASLConn struct {
+	// Context is the context of the current session which should be
+	// passed to the handler's methods.
+	Context context.Context
+
+	// Handler is the handler serving the current session.
+	Handler ContextHandler
+
+	// RemoteAddr is the address of the POP3 client.
+	RemoteAddr net.Addr
+
+	// TLS is the state of the TLS connection with the client or nil if
+	// the connection is not encrypted.
+	TLS *tls.ConnectionState
+
+	session *session
+}
+
+// Identify lets the server know which user the client is trying to
+// authenticate as. Mechanisms should call it as soon as the authentication
+// identity is known, before verifying the credentials, and abort the exchange
+// with the returned error if there is one. This way failed attempts are
+// attributed to the user and users who have been locked out are refused
+// without revealing whether their credentials were correct.
+func (c *SASLConn) Identify(username string) error {
+	if c.session == nil {
+		return nil
+	}
+	return c.session.identifySASLUser(username)
+}
+
+// defaultSASLMechanisms returns mechanisms enabled on servers which do not
+// specify SASLMechanisms.
+func defaultSASLMechanisms() map[string]SASLMechanism {
+	return map[string]SASLMechanism{
+		"CRAM-MD5":           CRAMMD5Mechanism{},
+		"EXTERNAL":           ExternalMechanism{},
+		"LOGIN":              LoginMechanism{},
+		"OAUTHBEARER":        OAuthBearerMechanism{},
+		"PLAIN":              PlainMechanism{},
+		"SCRAM-SHA-1":        SCRAMMechanism{Hash: crypto.SHA1},
+		"SCRAM-SHA-1-PLUS":   SCRAMMechanism{Hash: crypto.SHA1, Plus: true},
+		"SCRAM-SHA-256":      SCRAMMechanism{Hash: crypto.SHA256},
+		"SCRAM-SHA-256-PLUS": SCRAMMechanism{Hash: crypto.SHA256, Plus: true},
+		"XOAUTH2":            XOAuth2Mechanism{},
+	}
+}
+
+// saslConn describes the current session for the purpose of SASL exchanges.
+func (s *session) saslConn() *SASLConn {
+	return &SASLConn{
+		Context:    s.ctx,
+		Handler:    s.handler,
+		RemoteAddr: s.conn.RemoteAddr(),
+		TLS:        s.tlsState(),
+		session:    s,
+	}
+}
+
+// saslMechanisms returns a sorted list of names of SASL mechanisms available
+// in the current session.
+func (s *session) saslMechanisms() []string {
+	conn := s.saslConn()
+	var ret []string
+	for name, mechanism := range s.server.SASLMechanisms {
+		if mechanism.Available(conn) {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// offersChannelBinding reports whether any of the SASL mechanisms available
+// in the current session supports channel binding.
+func (s *session) offersChannelBinding() bool {
+	for _, name := range s.saslMechanisms() {
+		if strings.HasSuffix(name, "-PLUS") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAUTH is a callback for the SASL authentication exchange.
+// RFC 5034, page 3.
+func (s *session) handleAUTH(args []string) error {
+	if err := s.checkAuthLockout(""); err != nil {
+		return err
+	}
+	s.saslUser = ""
+	conn := s.saslConn()
+	mechanism, exists := s.server.SASLMechanisms[strings.ToUpper(args[0])]
+	if !exists || !mechanism.Available(conn) {
+		return errUnknownMechanism
+	}
+	server, err := mechanism.Start(conn)
+	if err != nil {
+		return err
+	}
+	var response []byte
+	if len(args) == 2 {
+		if response, err = decodeSASL(args[1]); err != nil {
+			return err
+		}
+	}
+	if err := s.exchangeSASL(server, response); err != nil {
+		return s.authFailed(s.saslUser, err)
+	}
+	// Mechanisms which do not identify the user upfront, or authenticate
+	// a different one, can only be checked once the exchange is complete.
+	if server.Username() != s.saslUser {
+		if err := s.checkAuthLockout(server.Username()); err != nil {
+			return err
+		}
+	}
+	if err := s.authSucceeded(server.Username()); err != nil {
+		return err
+	}
+	s.username = server.Username()
+	return s.signIn()
+}
+
+// identifySASLUser remembers the user the client is trying to authenticate as
+// with SASL and checks whether they have been locked out.
+func (s *session) identifySASLUser(username string) error {
+	s.saslUser = username
+	return s.checkAuthLockout(username)
+}
+
+// exchangeSASL keeps exchanging challenges and responses with the client
+// until the SASL server decides that the exchange is complete.
+func (s *session) exchangeSASL(server SASLServer, response []byte) error {
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil {
+			return err
+		}
+		if done && challenge == nil {
+			return nil
+		}
+		err = s.writer.PrintfLine(
+			"+ %s",
+			base64.StdEncoding.EncodeToString(challenge),
+		)
+		if err != nil {
+			return err
+		}
+		line, err := s.reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line == "*" {
+			return errAuthCancelled
+		}
+		if done {
+			// Additional data with success only expects an empty
+			// response from the client (RFC 5034, page 4).
+			if line != "" {
+				return errUnexpectedResponse
+			}
+			return nil
+		}
+		if response, err = decodeSASL(line); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeSASL decodes a base64-encoded client response where a single "="
+// stands for an empty initial response (RFC 5034, page 3).
+func decodeSASL(encoded string) ([]byte, error) {
+	if encoded == "=" {
+		return []byte{}, nil
+	}
+	ret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidEncoding
+	}
+	return ret, nil
+}
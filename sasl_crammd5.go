@@ -0,0 +1,84 @@
+package popart
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// CRAMMD5Mechanism implements the CRAM-MD5 SASL mechanism (RFC 2195). The
+// challenge is built the same way as the APOP banner and the digest is
+// verified by the server so the mechanism is only available if the Handler
+// implements CRAMSecretProvider.
+type CRAMMD5Mechanism struct{}
+
+// Available implements SASLMechanism.
+func (CRAMMD5Mechanism) Available(conn *SASLConn) bool {
+	_, ok := unwrapHandler(conn.Handler).(CRAMSecretProvider)
+	return ok && conn.session != nil
+}
+
+// Start implements SASLMechanism.
+func (CRAMMD5Mechanism) Start(conn *SASLConn) (SASLServer, error) {
+	provider, ok := unwrapHandler(conn.Handler).(CRAMSecretProvider)
+	if !ok || conn.session == nil {
+		return nil, errUnknownMechanism
+	}
+	challenge, err := conn.session.server.getBanner()
+	if err != nil {
+		return nil, err
+	}
+	return &cramMD5Server{
+		conn:      conn,
+		provider:  provider,
+		challenge: challenge,
+	}, nil
+}
+
+type cramMD5Server struct {
+	conn      *SASLConn
+	provider  CRAMSecretProvider
+	challenge string
+	username  string
+	sent      bool
+}
+
+func (c *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if !c.sent {
+		// CRAM-MD5 does not allow an initial response.
+		if response != nil {
+			return nil, false, errUnexpectedResponse
+		}
+		c.sent = true
+		return []byte(c.challenge), false, nil
+	}
+	sep := strings.LastIndex(string(response), " ")
+	if sep <= 0 {
+		return nil, false, errInvalidCredentials
+	}
+	username, digest := string(response[:sep]), string(response[sep+1:])
+	if err := c.conn.Identify(username); err != nil {
+		return nil, false, err
+	}
+	secret, err := c.provider.GetCRAMSecret(c.conn.Context, username)
+	if err != nil {
+		return nil, false, err
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(c.challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(digest)), []byte(expected)) != 1 {
+		return nil, false, errAuthFailed
+	}
+	if err := c.provider.Authorize(c.conn.Context, username); err != nil {
+		return nil, false, err
+	}
+	c.username = username
+	return nil, true, nil
+}
+
+func (c *cramMD5Server) Username() string {
+	return c.username
+}
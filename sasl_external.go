@@ -0,0 +1,61 @@
+package popart
+
+var errNoClientCertificate = NewReportableError("no verified client certificate")
+
+// ExternalMechanism implements the EXTERNAL SASL mechanism (RFC 4422,
+// appendix A) using the verified TLS client certificate as credentials. It is
+// only available on TLS connections where the client presented a certificate
+// which could be verified (see ClientAuth in crypto/tls Config) and if the
+// Handler implements CertificateAuthenticator.
+type ExternalMechanism struct{}
+
+// Available implements SASLMechanism.
+func (ExternalMechanism) Available(conn *SASLConn) bool {
+	_, ok := unwrapHandler(conn.Handler).(CertificateAuthenticator)
+	return ok && conn.TLS != nil && len(conn.TLS.VerifiedChains) > 0
+}
+
+// Start implements SASLMechanism.
+func (ExternalMechanism) Start(conn *SASLConn) (SASLServer, error) {
+	authenticator, ok := unwrapHandler(conn.Handler).(CertificateAuthenticator)
+	if !ok {
+		return nil, errUnknownMechanism
+	}
+	if conn.TLS == nil || len(conn.TLS.VerifiedChains) == 0 {
+		return nil, errNoClientCertificate
+	}
+	return &externalServer{authenticator: authenticator, conn: conn}, nil
+}
+
+type externalServer struct {
+	authenticator CertificateAuthenticator
+	conn          *SASLConn
+	started       bool
+	username      string
+}
+
+func (e *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil && !e.started {
+		e.started = true
+		return []byte{}, false, nil
+	}
+	if len(response) > 0 {
+		if err := e.conn.Identify(string(response)); err != nil {
+			return nil, false, err
+		}
+	}
+	username, err := e.authenticator.AuthenticateCertificate(
+		e.conn.Context,
+		string(response),
+		e.conn.TLS.VerifiedChains[0],
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	e.username = username
+	return nil, true, nil
+}
+
+func (e *externalServer) Username() string {
+	return e.username
+}
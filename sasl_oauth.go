@@ -0,0 +1,207 @@
+package popart
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+var errInvalidAuthScheme = NewReportableError("unsupported authorization scheme")
+
+// OAuthBearerMechanism implements the OAUTHBEARER SASL mechanism (RFC 7628).
+// It is only available if the Handler implements TokenAuthenticator.
+type OAuthBearerMechanism struct {
+	// Scope is an optional OAuth scope returned to the client if the
+	// token is rejected.
+	Scope string
+
+	// OpenIDConfiguration is an optional URL of the OpenID Connect
+	// discovery document returned to the client if the token is rejected.
+	OpenIDConfiguration string
+}
+
+// Available implements SASLMechanism.
+func (OAuthBearerMechanism) Available(conn *SASLConn) bool {
+	_, ok := unwrapHandler(conn.Handler).(TokenAuthenticator)
+	return ok
+}
+
+// Start implements SASLMechanism.
+func (m OAuthBearerMechanism) Start(conn *SASLConn) (SASLServer, error) {
+	authenticator, ok := unwrapHandler(conn.Handler).(TokenAuthenticator)
+	if !ok {
+		return nil, errUnknownMechanism
+	}
+	return &oauthServer{
+		conn:          conn,
+		authenticator: authenticator,
+		parse:         parseOAuthBearer,
+		failure: oauthFailure{
+			Status:              "invalid_token",
+			Scope:               m.Scope,
+			OpenIDConfiguration: m.OpenIDConfiguration,
+		},
+	}, nil
+}
+
+// XOAuth2Mechanism implements the XOAUTH2 SASL mechanism, a non-standard
+// predecessor of OAUTHBEARER still used by a number of clients. It is only
+// available if the Handler implements TokenAuthenticator.
+type XOAuth2Mechanism struct {
+	// Scope is an optional OAuth scope returned to the client if the
+	// token is rejected.
+	Scope string
+}
+
+// Available implements SASLMechanism.
+func (XOAuth2Mechanism) Available(conn *SASLConn) bool {
+	_, ok := unwrapHandler(conn.Handler).(TokenAuthenticator)
+	return ok
+}
+
+// Start implements SASLMechanism.
+func (m XOAuth2Mechanism) Start(conn *SASLConn) (SASLServer, error) {
+	authenticator, ok := unwrapHandler(conn.Handler).(TokenAuthenticator)
+	if !ok {
+		return nil, errUnknownMechanism
+	}
+	return &oauthServer{
+		conn:          conn,
+		authenticator: authenticator,
+		parse:         parseXOAuth2,
+		failure: oauthFailure{
+			Status:  "401",
+			Schemes: "bearer",
+			Scope:   m.Scope,
+		},
+	}, nil
+}
+
+// oauthFailure is the JSON document sent to the client as the error challenge
+// when the token is rejected (RFC 7628, page 11).
+type oauthFailure struct {
+	Status              string `json:"status"`
+	Schemes             string `json:"schemes,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	OpenIDConfiguration string `json:"openid-configuration,omitempty"`
+}
+
+type oauthServer struct {
+	conn          *SASLConn
+	authenticator TokenAuthenticator
+	parse         func(response []byte) (username, token string, err error)
+	failure       oauthFailure
+	started       bool
+	username      string
+	err           error
+}
+
+func (o *oauthServer) Next(response []byte) ([]byte, bool, error) {
+	if o.err != nil {
+		// The client has acknowledged the error challenge so now we
+		// can fail the exchange.
+		return nil, false, o.err
+	}
+	if response == nil && !o.started {
+		o.started = true
+		return []byte{}, false, nil
+	}
+	username, token, err := o.parse(response)
+	if err != nil {
+		return nil, false, err
+	}
+	if username != "" {
+		if err := o.conn.Identify(username); err != nil {
+			return nil, false, err
+		}
+	}
+	o.username, err = o.authenticator.AuthenticateToken(o.conn.Context, username, token)
+	if err == nil {
+		return nil, true, nil
+	}
+	if _, isReportable := err.(*ReportableError); !isReportable {
+		return nil, false, err
+	}
+	challenge, jsonErr := json.Marshal(o.failure)
+	if jsonErr != nil {
+		return nil, false, jsonErr
+	}
+	o.err = err
+	return challenge, false, nil
+}
+
+func (o *oauthServer) Username() string {
+	return o.username
+}
+
+// parseOAuthBearer parses the OAUTHBEARER client response (RFC 7628, page 7).
+func parseOAuthBearer(response []byte) (string, string, error) {
+	parts := bytes.SplitN(response, []byte{1}, 2)
+	if len(parts) != 2 {
+		return "", "", errInvalidCredentials
+	}
+	gs2 := strings.Split(string(parts[0]), ",")
+	if len(gs2) != 3 || gs2[2] != "" {
+		return "", "", errInvalidCredentials
+	}
+	switch {
+	case gs2[0] == "n" || gs2[0] == "y":
+	case strings.HasPrefix(gs2[0], "p="):
+		return "", "", errChannelBindingType
+	default:
+		return "", "", errInvalidCredentials
+	}
+	var username string
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", errInvalidCredentials
+		}
+		username = decodeSASLName(gs2[1][2:])
+	}
+	values, err := parseOAuthValues(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+	token, err := bearerToken(values["auth"])
+	return username, token, err
+}
+
+// parseXOAuth2 parses the XOAUTH2 client response which consists of the user
+// and auth key-value pairs.
+func parseXOAuth2(response []byte) (string, string, error) {
+	values, err := parseOAuthValues(response)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := bearerToken(values["auth"])
+	return values["user"], token, err
+}
+
+// parseOAuthValues parses a list of key-value pairs separated with 0x01 bytes
+// and terminated with a double 0x01.
+func parseOAuthValues(data []byte) (map[string]string, error) {
+	if !bytes.HasSuffix(data, []byte{1, 1}) {
+		return nil, errInvalidCredentials
+	}
+	ret := make(map[string]string)
+	for _, pair := range bytes.Split(data[:len(data)-2], []byte{1}) {
+		kv := strings.SplitN(string(pair), "=", 2)
+		if len(kv) != 2 {
+			return nil, errInvalidCredentials
+		}
+		ret[kv[0]] = kv[1]
+	}
+	return ret, nil
+}
+
+// bearerToken extracts the token from the value of the auth key.
+func bearerToken(auth string) (string, error) {
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", errInvalidAuthScheme
+	}
+	if parts[1] == "" {
+		return "", errInvalidCredentials
+	}
+	return parts[1], nil
+}
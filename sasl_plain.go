@@ -0,0 +1,122 @@
+package popart
+
+import (
+	"bytes"
+)
+
+var (
+	errInvalidCredentials = NewReportableError("malformed credentials")
+	errUnsupportedAuthzID = NewReportableError("authorization identity must match authentication identity")
+)
+
+// PlainMechanism implements the PLAIN SASL mechanism (RFC 4616) on top of
+// Handler's AuthenticatePASS method.
+type PlainMechanism struct{}
+
+// Available implements SASLMechanism.
+func (PlainMechanism) Available(conn *SASLConn) bool {
+	return true
+}
+
+// Start implements SASLMechanism.
+func (PlainMechanism) Start(conn *SASLConn) (SASLServer, error) {
+	return &plainServer{conn: conn}, nil
+}
+
+type plainServer struct {
+	conn     *SASLConn
+	username string
+	started  bool
+}
+
+func (p *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil && !p.started {
+		// The client did not provide an initial response so we need
+		// to ask for it with an empty challenge.
+		p.started = true
+		return []byte{}, false, nil
+	}
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, errInvalidCredentials
+	}
+	authzID, authcID, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authcID == "" || password == "" {
+		return nil, false, errInvalidCredentials
+	}
+	if authzID != "" && authzID != authcID {
+		return nil, false, errUnsupportedAuthzID
+	}
+	if err := p.conn.Identify(authcID); err != nil {
+		return nil, false, err
+	}
+	if err := p.conn.Handler.AuthenticatePASS(p.conn.Context, authcID, password); err != nil {
+		return nil, false, err
+	}
+	p.username = authcID
+	return nil, true, nil
+}
+
+func (p *plainServer) Username() string {
+	return p.username
+}
+
+// LoginMechanism implements the obsolete but still widely used LOGIN SASL
+// mechanism (draft-murchison-sasl-login) on top of Handler's AuthenticatePASS
+// method.
+type LoginMechanism struct{}
+
+// Available implements SASLMechanism.
+func (LoginMechanism) Available(conn *SASLConn) bool {
+	return true
+}
+
+// Start implements SASLMechanism.
+func (LoginMechanism) Start(conn *SASLConn) (SASLServer, error) {
+	return &loginServer{conn: conn}, nil
+}
+
+type loginServer struct {
+	conn     *SASLConn
+	username string
+	step     int
+}
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	l.step++
+	switch l.step {
+	case 1:
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		// Some clients send the username as the initial response.
+		l.step++
+		fallthrough
+	case 2:
+		if len(response) == 0 {
+			return nil, false, errInvalidCredentials
+		}
+		l.username = string(response)
+		return []byte("Password:"), false, nil
+	default:
+		if len(response) == 0 {
+			return nil, false, errInvalidCredentials
+		}
+		if err := l.conn.Identify(l.username); err != nil {
+			return nil, false, err
+		}
+		err := l.conn.Handler.AuthenticatePASS(
+			l.conn.Context,
+			l.username,
+			string(response),
+		)
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+}
+
+func (l *loginServer) Username() string {
+	return l.username
+}
@@ -0,0 +1,293 @@
+package popart
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	_ "crypto/sha1"   // registers crypto.SHA1
+	_ "crypto/sha256" // registers crypto.SHA256
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+var (
+	errAuthFailed              = NewCodedError(CodeAuth, "authentication failed")
+	errChannelBindingMismatch  = NewReportableError("channel binding mismatch")
+	errChannelBindingRequired  = NewReportableError("channel binding required")
+	errChannelBindingDowngrade = NewReportableError("server does support channel binding")
+	errChannelBindingType      = NewReportableError("unsupported channel binding type")
+	errInvalidNonce            = NewReportableError("invalid nonce")
+)
+
+// scramHashNames maps hash functions supported by SCRAMMechanism to their
+// names used in the SCRAM mechanism family (RFC 5802, page 8).
+var scramHashNames = map[crypto.Hash]string{
+	crypto.SHA1:   "SHA-1",
+	crypto.SHA256: "SHA-256",
+}
+
+// SCRAMMechanism implements SCRAM-SHA-1 and SCRAM-SHA-256 SASL mechanisms
+// (RFC 5802, RFC 7677) along with their channel-binding -PLUS variants. It is
+// only available if the Handler implements SCRAMCredentialsProvider.
+type SCRAMMechanism struct {
+	// Hash is either crypto.SHA1 or crypto.SHA256.
+	Hash crypto.Hash
+
+	// Plus requires the client to bind the exchange to the underlying TLS
+	// channel using either tls-unique (RFC 5929) or tls-exporter (RFC 9266)
+	// channel binding type. Such mechanism is only available to clients
+	// connected over TLS.
+	Plus bool
+}
+
+// Available implements SASLMechanism.
+func (m SCRAMMechanism) Available(conn *SASLConn) bool {
+	if _, ok := unwrapHandler(conn.Handler).(SCRAMCredentialsProvider); !ok {
+		return false
+	}
+	if _, ok := scramHashNames[m.Hash]; !ok || !m.Hash.Available() {
+		return false
+	}
+	return !m.Plus || len(channelBindingTypes(conn.TLS)) > 0
+}
+
+// Start implements SASLMechanism.
+func (m SCRAMMechanism) Start(conn *SASLConn) (SASLServer, error) {
+	provider, ok := unwrapHandler(conn.Handler).(SCRAMCredentialsProvider)
+	if !ok {
+		return nil, errUnknownMechanism
+	}
+	return &scramServer{
+		mechanism: m,
+		conn:      conn,
+		provider:  provider,
+	}, nil
+}
+
+type scramServer struct {
+	mechanism SCRAMMechanism
+	conn      *SASLConn
+	provider  SCRAMCredentialsProvider
+	started   bool
+
+	username        string
+	gs2Header       string
+	channelBinding  []byte
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	saltedPassword  []byte
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	if s.serverFirst == "" {
+		if response == nil && !s.started {
+			s.started = true
+			return []byte{}, false, nil
+		}
+		challenge, err := s.handleClientFirst(string(response))
+		return challenge, false, err
+	}
+	challenge, err := s.handleClientFinal(string(response))
+	return challenge, err == nil, err
+}
+
+func (s *scramServer) Username() string {
+	return s.username
+}
+
+// handleClientFirst parses the client-first-message and responds with the
+// server-first-message (RFC 5802, page 13).
+func (s *scramServer) handleClientFirst(message string) ([]byte, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, errInvalidCredentials
+	}
+	if err := s.negotiateChannelBinding(parts[0]); err != nil {
+		return nil, err
+	}
+	authzID := parts[1]
+	if authzID != "" {
+		if !strings.HasPrefix(authzID, "a=") {
+			return nil, errInvalidCredentials
+		}
+		authzID = decodeSASLName(authzID[2:])
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 ||
+		!strings.HasPrefix(attrs[0], "n=") ||
+		!strings.HasPrefix(attrs[1], "r=") ||
+		len(attrs[0]) == 2 ||
+		len(attrs[1]) == 2 {
+		return nil, errInvalidCredentials
+	}
+	s.username = decodeSASLName(attrs[0][2:])
+	if authzID != "" && authzID != s.username {
+		return nil, errUnsupportedAuthzID
+	}
+	if err := s.conn.Identify(s.username); err != nil {
+		return nil, err
+	}
+	saltedPassword, salt, iterations, err := s.provider.GetSCRAMCredentials(
+		s.conn.Context,
+		scramHashNames[s.mechanism.Hash],
+		s.username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	serverNonce, err := randomString(18)
+	if err != nil {
+		return nil, err
+	}
+	s.saltedPassword = saltedPassword
+	s.nonce = attrs[1][2:] + serverNonce
+	s.serverFirst = fmt.Sprintf(
+		"r=%s,s=%s,i=%d",
+		s.nonce,
+		base64.StdEncoding.EncodeToString(salt),
+		iterations,
+	)
+	return []byte(s.serverFirst), nil
+}
+
+// negotiateChannelBinding validates the channel binding flag sent by the
+// client against the mechanism used (RFC 5802, page 16).
+func (s *scramServer) negotiateChannelBinding(flag string) error {
+	if s.mechanism.Plus {
+		if !strings.HasPrefix(flag, "p=") {
+			return errChannelBindingRequired
+		}
+		data, ok := channelBinding(s.conn.TLS, flag[2:])
+		if !ok {
+			return errChannelBindingType
+		}
+		s.channelBinding = data
+		return nil
+	}
+	switch {
+	case flag == "n":
+		return nil
+	case flag == "y":
+		// The client supports channel binding but thinks the server
+		// does not. If it does, somebody may have tampered with the
+		// list of mechanisms.
+		if s.conn.session != nil && s.conn.session.offersChannelBinding() {
+			return errChannelBindingDowngrade
+		}
+		return nil
+	case strings.HasPrefix(flag, "p="):
+		return errChannelBindingType
+	}
+	return errInvalidCredentials
+}
+
+// handleClientFinal verifies the client-final-message and responds with the
+// server-final-message (RFC 5802, page 14).
+func (s *scramServer) handleClientFinal(message string) ([]byte, error) {
+	proofAt := strings.LastIndex(message, ",p=")
+	if proofAt < 0 {
+		return nil, errInvalidCredentials
+	}
+	withoutProof := message[:proofAt]
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 ||
+		!strings.HasPrefix(attrs[0], "c=") ||
+		!strings.HasPrefix(attrs[1], "r=") {
+		return nil, errInvalidCredentials
+	}
+	binding, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, errInvalidEncoding
+	}
+	expected := append([]byte(s.gs2Header), s.channelBinding...)
+	if subtle.ConstantTimeCompare(binding, expected) != 1 {
+		return nil, errChannelBindingMismatch
+	}
+	if attrs[1][2:] != s.nonce {
+		return nil, errInvalidNonce
+	}
+	proof, err := base64.StdEncoding.DecodeString(message[proofAt+3:])
+	if err != nil {
+		return nil, errInvalidEncoding
+	}
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientKey := s.hmac(s.saltedPassword, []byte("Client Key"))
+	storedKey := s.hash(clientKey)
+	clientSignature := s.hmac(storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, errAuthFailed
+	}
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	if subtle.ConstantTimeCompare(s.hash(proof), storedKey) != 1 {
+		return nil, errAuthFailed
+	}
+	if err := s.provider.Authorize(s.conn.Context, s.username); err != nil {
+		return nil, err
+	}
+	serverKey := s.hmac(s.saltedPassword, []byte("Server Key"))
+	serverSignature := s.hmac(serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+func (s *scramServer) hmac(key, message []byte) []byte {
+	mac := hmac.New(s.mechanism.Hash.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func (s *scramServer) hash(message []byte) []byte {
+	h := s.mechanism.Hash.New()
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// channelBindingTypes returns the list of channel binding types supported on
+// a TLS connection.
+func channelBindingTypes(state *tls.ConnectionState) []string {
+	var ret []string
+	for _, cbType := range []string{"tls-exporter", "tls-unique"} {
+		if _, ok := channelBinding(state, cbType); ok {
+			ret = append(ret, cbType)
+		}
+	}
+	return ret
+}
+
+// channelBinding returns channel binding data of a given type for a TLS
+// connection.
+func channelBinding(state *tls.ConnectionState, cbType string) ([]byte, bool) {
+	if state == nil {
+		return nil, false
+	}
+	switch cbType {
+	case "tls-unique":
+		return state.TLSUnique, state.TLSUnique != nil
+	case "tls-exporter":
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		return data, err == nil
+	}
+	return nil, false
+}
+
+// decodeSASLName reverses the escaping of commas and equal signs in SCRAM
+// usernames (RFC 5802, page 10).
+func decodeSASLName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
+
+// randomString returns a base64-encoded string of n random bytes.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
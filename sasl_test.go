@@ -0,0 +1,363 @@
+package popart
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const (
+	testSecret     = "secret"
+	testToken      = "good-token"
+	testIterations = 4096
+)
+
+var testSalt = []byte("NaCl and pepper")
+
+// saslBackend is a testBackend implementing all the optional interfaces
+// needed by the SASL mechanisms and APOP.
+type saslBackend struct {
+	*testBackend
+}
+
+func newSASLBackend() *saslBackend {
+	return &saslBackend{testBackend: newTestBackend("hello\r\n")}
+}
+
+func (b *saslBackend) Authorize(ctx context.Context, username string) error {
+	if username != "alice" {
+		return NewReportableError("no such user")
+	}
+	return nil
+}
+
+func (b *saslBackend) GetSCRAMCredentials(ctx context.Context, hash, username string) ([]byte, []byte, int, error) {
+	if hash != "SHA-256" {
+		return nil, nil, 0, NewReportableError("unsupported hash")
+	}
+	return scramHi([]byte(testSecret), testSalt, testIterations), testSalt, testIterations, nil
+}
+
+func (b *saslBackend) GetCRAMSecret(ctx context.Context, username string) (string, error) {
+	return testSecret, nil
+}
+
+func (b *saslBackend) GetAPOPSecret(ctx context.Context, username string) (string, error) {
+	return testSecret, nil
+}
+
+func (b *saslBackend) AuthenticateToken(ctx context.Context, username, token string) (string, error) {
+	if token != testToken || (username != "" && username != "alice") {
+		return "", NewReportableError("invalid token")
+	}
+	return "alice", nil
+}
+
+// scramHi is the Hi function from RFC 5802, page 7, for SHA-256.
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	ret := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range ret {
+			ret[j] ^= u[j]
+		}
+	}
+	return ret
+}
+
+func hmacSHA256(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func b64(data string) string {
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+// challenge decodes a "+ <base64>" continuation line.
+func challenge(t *testing.T, line string) string {
+	t.Helper()
+	if !strings.HasPrefix(line, "+ ") {
+		t.Fatalf("expected a challenge, got %q", line)
+	}
+	data, err := base64.StdEncoding.DecodeString(line[2:])
+	if err != nil {
+		t.Fatalf("invalid challenge %q: %v", line, err)
+	}
+	return string(data)
+}
+
+func dialSASL(t *testing.T, srv *Server) *testClient {
+	if srv.Backend == nil {
+		srv.Backend = newSASLBackend()
+	}
+	client := serveTest(t, srv).dial(t)
+	client.line()
+	return client
+}
+
+func TestPlain(t *testing.T) {
+	client := dialSASL(t, &Server{})
+	client.expect("-ERR [AUTH] invalid credentials", "AUTH PLAIN %s", b64("\x00alice\x00wrong"))
+	client.expect("-ERR [AUTH] malformed", "AUTH PLAIN %s", b64("alice secret"))
+	client.expect("-ERR invalid base64", "AUTH PLAIN !!!")
+	client.expect("-ERR [AUTH] authorization identity", "AUTH PLAIN %s", b64("bob\x00alice\x00secret"))
+	if line := client.cmd("AUTH PLAIN"); line != "+ " {
+		t.Fatalf("expected an empty challenge, got %q", line)
+	}
+	client.expect("-ERR authentication cancelled", "*")
+	client.expect("+ ", "AUTH PLAIN")
+	client.expect("+OK", b64("\x00alice\x00secret"))
+}
+
+func TestLogin(t *testing.T) {
+	client := dialSASL(t, &Server{})
+	if prompt := challenge(t, client.cmd("AUTH LOGIN")); prompt != "Username:" {
+		t.Fatalf("unexpected prompt %q", prompt)
+	}
+	if prompt := challenge(t, client.cmd(b64("alice"))); prompt != "Password:" {
+		t.Fatalf("unexpected prompt %q", prompt)
+	}
+	client.expect("+OK", b64("secret"))
+}
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange.
+type scramClient struct {
+	gs2Header      string
+	channelBinding []byte
+	clientNonce    string
+	clientFirst    string
+	authMessage    string
+	saltedPassword []byte
+}
+
+func newSCRAMClient(gs2Header string, channelBinding []byte) *scramClient {
+	c := &scramClient{
+		gs2Header:      gs2Header,
+		channelBinding: channelBinding,
+		clientNonce:    "rOprNGfwEbeRWgbNEkqO",
+	}
+	c.clientFirst = "n=alice,r=" + c.clientNonce
+	return c
+}
+
+func (c *scramClient) first() string {
+	return b64(c.gs2Header + c.clientFirst)
+}
+
+// final builds the client-final-message in response to the server-first
+// message using the given password.
+func (c *scramClient) final(t *testing.T, serverFirst, password string) string {
+	t.Helper()
+	attrs := strings.Split(serverFirst, ",")
+	if len(attrs) != 3 || !strings.HasPrefix(attrs[0], "r="+c.clientNonce) {
+		t.Fatalf("invalid server-first-message %q", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1][2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.saltedPassword = scramHi([]byte(password), salt, testIterations)
+	binding := base64.StdEncoding.EncodeToString(append([]byte(c.gs2Header), c.channelBinding...))
+	withoutProof := "c=" + binding + "," + attrs[0]
+	c.authMessage = c.clientFirst + "," + serverFirst + "," + withoutProof
+	clientKey := hmacSHA256(c.saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], []byte(c.authMessage))
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return b64(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+// verify checks the server-final-message.
+func (c *scramClient) verify(t *testing.T, serverFinal string) {
+	t.Helper()
+	serverKey := hmacSHA256(c.saltedPassword, []byte("Server Key"))
+	expected := "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, []byte(c.authMessage)))
+	if serverFinal != expected {
+		t.Fatalf("got server signature %q, expected %q", serverFinal, expected)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	client := dialSASL(t, &Server{})
+
+	scram := newSCRAMClient("n,,", nil)
+	serverFirst := challenge(t, client.cmd("AUTH SCRAM-SHA-256 %s", scram.first()))
+	client.expect("-ERR [AUTH]", scram.final(t, serverFirst, "wrong"))
+
+	client.expect("-ERR [AUTH] unsupported channel binding", "AUTH SCRAM-SHA-256 %s", b64("p=tls-unique,,n=alice,r=abc"))
+	client.expect("-ERR [AUTH] malformed", "AUTH SCRAM-SHA-256 %s", b64("n,,r=abc"))
+	client.expect("-ERR [AUTH] malformed", "AUTH SCRAM-SHA-256 %s", b64("x,,n=alice,r=abc"))
+
+	scram = newSCRAMClient("n,a=alice,", nil)
+	serverFirst = challenge(t, client.cmd("AUTH SCRAM-SHA-256 %s", scram.first()))
+	scram.verify(t, challenge(t, client.cmd(scram.final(t, serverFirst, testSecret))))
+	client.expect("+OK", "")
+}
+
+func TestSCRAMWithTamperedNonce(t *testing.T) {
+	client := dialSASL(t, &Server{})
+	scram := newSCRAMClient("n,,", nil)
+	serverFirst := challenge(t, client.cmd("AUTH SCRAM-SHA-256 %s", scram.first()))
+	final, _ := base64.StdEncoding.DecodeString(scram.final(t, serverFirst, testSecret))
+	client.expect("-ERR [AUTH] invalid nonce", b64(strings.Replace(string(final), ",r=", ",r=x", 1)))
+}
+
+func TestSCRAMPlus(t *testing.T) {
+	srv := &Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+	client := dialSASL(t, srv)
+	client.expect("+OK", "STLS")
+	tlsConn := tls.Client(client.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client = newTestClient(t, tlsConn)
+	state := tlsConn.ConnectionState()
+	binding, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client which supports channel binding but did not see it offered.
+	downgraded := newSCRAMClient("y,,", nil)
+	client.expect("-ERR [AUTH] server does support", "AUTH SCRAM-SHA-256 %s", downgraded.first())
+
+	forged := newSCRAMClient("p=tls-exporter,,", []byte("forged"))
+	serverFirst := challenge(t, client.cmd("AUTH SCRAM-SHA-256-PLUS %s", forged.first()))
+	client.expect("-ERR [AUTH] channel binding mismatch", forged.final(t, serverFirst, testSecret))
+
+	scram := newSCRAMClient("p=tls-exporter,,", binding)
+	serverFirst = challenge(t, client.cmd("AUTH SCRAM-SHA-256-PLUS %s", scram.first()))
+	scram.verify(t, challenge(t, client.cmd(scram.final(t, serverFirst, testSecret))))
+	client.expect("+OK", "")
+}
+
+func cramResponse(challenge, secret string) string {
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(challenge))
+	return b64("alice " + hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestCRAMMD5(t *testing.T) {
+	client := dialSASL(t, &Server{})
+	client.expect("-ERR [AUTH] unexpected client response", "AUTH CRAM-MD5 %s", b64("alice"))
+	cramChallenge := challenge(t, client.cmd("AUTH CRAM-MD5"))
+	client.expect("-ERR [AUTH]", cramResponse(cramChallenge, "wrong"))
+	client.expect("+ ", "AUTH CRAM-MD5")
+	client.expect("-ERR [AUTH] malformed", b64("alice"))
+	cramChallenge = challenge(t, client.cmd("AUTH CRAM-MD5"))
+	client.expect("+OK", cramResponse(cramChallenge, testSecret))
+}
+
+func apopDigest(banner, secret string) string {
+	digest := md5.Sum([]byte(banner + secret))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestAPOP(t *testing.T) {
+	srv := &Server{Backend: newSASLBackend(), APOP: true, APOPReplayWindow: 60e9}
+	listener := serveTest(t, srv)
+	client := listener.dial(t)
+	greeting := client.line()
+	banner := greeting[strings.LastIndex(greeting, " ")+1:]
+	if !strings.HasPrefix(banner, "<") || !strings.HasSuffix(banner, ">") {
+		t.Fatalf("no banner in greeting %q", greeting)
+	}
+	client.expect("-ERR [AUTH]", "APOP alice %s", apopDigest(banner, "wrong"))
+	digest := apopDigest(banner, testSecret)
+	client.expect("+OK", "APOP alice %s", strings.ToUpper(digest))
+	client.expect("+OK", "QUIT")
+
+	// The same digest must not be accepted again.
+	replaying := listener.dial(t)
+	replaying.line()
+	replaying.expect("-ERR [AUTH] APOP digest already used", "APOP alice %s", digest)
+}
+
+func TestOAuthBearer(t *testing.T) {
+	client := dialSASL(t, &Server{
+		SASLMechanisms: map[string]SASLMechanism{
+			"OAUTHBEARER": OAuthBearerMechanism{Scope: "mail"},
+		},
+	})
+	failure := challenge(t, client.cmd("AUTH OAUTHBEARER %s", b64("n,a=alice,\x01auth=Bearer bad\x01\x01")))
+	var document map[string]string
+	if err := json.Unmarshal([]byte(failure), &document); err != nil {
+		t.Fatalf("invalid error challenge %q: %v", failure, err)
+	}
+	if document["status"] != "invalid_token" || document["scope"] != "mail" {
+		t.Errorf("unexpected error challenge %q", failure)
+	}
+	client.expect("-ERR [AUTH] invalid token", b64("\x01"))
+
+	client.expect("-ERR [AUTH] malformed", "AUTH OAUTHBEARER %s", b64("n,a=alice\x01auth=Bearer x\x01\x01"))
+	client.expect("-ERR [AUTH] malformed", "AUTH OAUTHBEARER %s", b64("n,a=alice,\x01auth=Bearer x\x01"))
+	client.expect("-ERR [AUTH] unsupported channel binding", "AUTH OAUTHBEARER %s", b64("p=tls-unique,,\x01auth=Bearer x\x01\x01"))
+	client.expect("-ERR [AUTH] unsupported authorization scheme", "AUTH OAUTHBEARER %s", b64("n,,\x01auth=Basic x\x01\x01"))
+	client.expect("+OK", "AUTH OAUTHBEARER %s", b64("n,a=alice,\x01host=localhost\x01auth=Bearer "+testToken+"\x01\x01"))
+}
+
+func TestXOAuth2(t *testing.T) {
+	client := dialSASL(t, &Server{})
+	failure := challenge(t, client.cmd("AUTH XOAUTH2 %s", b64("user=alice\x01auth=Bearer bad\x01\x01")))
+	if !strings.Contains(failure, `"status":"401"`) {
+		t.Errorf("unexpected error challenge %q", failure)
+	}
+	client.expect("-ERR [AUTH] invalid token", "")
+	client.expect("+OK", "AUTH XOAUTH2 %s", b64("user=alice\x01auth=Bearer "+testToken+"\x01\x01"))
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	for encoded, expected := range map[string]string{
+		"alice":       "alice",
+		"a=2Cb":       "a,b",
+		"a=3Db=3D=2C": "a=b=,",
+	} {
+		if decoded := decodeSASLName(encoded); decoded != expected {
+			t.Errorf("decodeSASLName(%q) = %q, expected %q", encoded, decoded, expected)
+		}
+	}
+}
+
+func TestParseOAuthBearer(t *testing.T) {
+	for _, tc := range []struct {
+		response string
+		username string
+		token    string
+		err      error
+	}{
+		{"n,,\x01auth=Bearer abc\x01\x01", "", "abc", nil},
+		{"y,a=a=2Cb,\x01host=x\x01auth=bearer abc\x01\x01", "a,b", "abc", nil},
+		{"n,,\x01auth=Bearer \x01\x01", "", "", errInvalidCredentials},
+		{"n,,\x01auth=Bearer abc\x01", "", "", errInvalidCredentials},
+		{"n,,\x01auth\x01\x01", "", "", errInvalidCredentials},
+		{"n,,\x01host=x\x01\x01", "", "", errInvalidAuthScheme},
+		{"n,alice,\x01auth=Bearer abc\x01\x01", "", "", errInvalidCredentials},
+		{"n,,x\x01auth=Bearer abc\x01\x01", "", "", errInvalidCredentials},
+		{"x,,\x01auth=Bearer abc\x01\x01", "", "", errInvalidCredentials},
+		{"p=tls-unique,,\x01auth=Bearer abc\x01\x01", "", "", errChannelBindingType},
+		{"n,,", "", "", errInvalidCredentials},
+	} {
+		username, token, err := parseOAuthBearer([]byte(tc.response))
+		if username != tc.username || token != tc.token || err != tc.err {
+			t.Errorf("parseOAuthBearer(%q) = %q, %q, %v; expected %q, %q, %v",
+				tc.response, username, token, err, tc.username, tc.token, tc.err)
+		}
+	}
+}
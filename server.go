@@ -1,25 +1,50 @@
 package popart
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrServerClosed is returned by the Server's Serve method after a call to
+// Shutdown or Close.
+var ErrServerClosed = errors.New("popart: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all sessions have
+// finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
 // Server listens for incoming POP3 connections and handles them with the help
 // of Handler objects passed via dependency injection.
 type Server struct {
 	// Hostname defines how the server should introduce itself. It is only
-	// really important if the server is supposed to support APOP
-	// authentication method.
+	// really important if the server is supposed to support APOP or
+	// CRAM-MD5 authentication methods.
 	Hostname string
 
 	// OnNewConnection is a callback capable of producing Handler objects
 	// to handle incoming connections.
 	OnNewConnection func(peer net.Addr) Handler
 
+	// OnNewSession is an alternative to OnNewConnection producing
+	// ContextHandler objects. The context passed to it is the one which
+	// will be passed to all the handler's methods.
+	OnNewSession func(ctx context.Context, peer net.Addr) ContextHandler
+
+	// Backend is an alternative to OnNewConnection and OnNewSession for
+	// servers which use a single Backend for all sessions instead of
+	// building handlers for each connection. Exactly one of
+	// OnNewConnection, OnNewSession and Backend must be set.
+	Backend Backend
+
 	// Timeout allows setting an inactivity autologout timer. According to
 	// rfc1939 such a timer MUST be of at least 10 minutes' duration.
 	Timeout time.Duration
@@ -28,37 +53,321 @@ type Server struct {
 	// name to the POP3 client. The default one is "popart".
 	Implementation string
 
-	// Expire allows the server to provide message expiration advice to the
-	// client. The default one is "NEVER".
+	// Expire sets the message expiration policy announced to the client,
+	// either "NEVER" (the default) or the number of days messages are
+	// kept on the server after being retrieved. It is enforced by the
+	// server: with "0" messages retrieved with RETR are deleted at the end
+	// of the session, otherwise retrievals are tracked and messages
+	// retrieved earlier than that are hidden from the client and deleted.
+	// Retrievals are tracked by the handler if it implements
+	// RetrievalTracker and with UserStates otherwise.
+	// RFC 2449, page 6.
 	Expire string
 
+	// LoginDelay is the minimum time between two logins of the same user.
+	// If set, it is announced to the client and logins which come too
+	// early are refused. Zero disables the policy.
+	// RFC 2449, page 8.
+	LoginDelay time.Duration
+
+	// AccessControl, if set, restricts addresses clients can connect from.
+	// Connections from addresses denied by its global rules are rejected
+	// before OnNewConnection is called, and users denied by their own
+	// rules are refused once they authenticate.
+	AccessControl *AccessControl
+
+	// AuthThrottle, if set, slows down and eventually locks out clients
+	// which repeatedly fail to authenticate.
+	AuthThrottle *AuthThrottle
+
+	// UserStates stores per-user state needed to enforce the Expire and
+	// LoginDelay policies. By default it is kept in memory.
+	UserStates UserStateStore
+
 	// APOP determines whether the server should implement the APOP
 	// authentication method.
 	APOP bool
 
-	// capabilites is a pre-calculated set of things server can announce to
-	// the client upon receiving the CAPA command.
-	capabilities []string
+	// APOPReplayWindow enables rejecting APOP digests which have already
+	// been used within the given time window, no matter by which client.
+	// Since each banner is unique a legitimate client will never produce
+	// the same digest twice. Zero disables the check.
+	APOPReplayWindow time.Duration
+
+	// TLSConfig enables the STLS command (RFC 2595) which allows the client
+	// to upgrade a plaintext connection to TLS. If nil, STLS is not
+	// supported.
+	TLSConfig *tls.Config
+
+	// RequireTLS determines whether the server should refuse to
+	// authenticate clients over plaintext connections. If set, USER, PASS
+	// and APOP commands will fail and USER will not be announced to the
+	// client until the connection is secured, either by the Listener or
+	// with the STLS command.
+	RequireTLS bool
+
+	// ExactSizes makes the server report exact message sizes, as they
+	// appear on the wire (with CRLF line endings, but without dot escapes
+	// and the termination line). Sizes are obtained from the handler if it
+	// implements ExactSizer. Otherwise each message is read in full to
+	// measure it upon the first login which sees it and its size is kept
+	// in SizeStore, so a store shared by all servers serving the same
+	// maildrops spares them reading messages again. A session error is
+	// reported whenever a message sent in response to RETR differs in size
+	// from what was announced.
+	ExactSizes bool
+
+	// SizeStore keeps message sizes measured due to ExactSizes across
+	// sessions. By default it is kept in memory.
+	SizeStore SizeStore
+
+	// SASLMechanisms maps upper-case names of SASL mechanisms to their
+	// implementations. Mechanisms listed here can be used with the AUTH
+	// command (RFC 5034) and are announced in response to CAPA, but only
+	// those whose Available method returns true for the connection. If
+	// nil, CRAM-MD5, EXTERNAL, LOGIN, OAUTHBEARER, PLAIN, SCRAM-SHA-1,
+	// SCRAM-SHA-1-PLUS, SCRAM-SHA-256, SCRAM-SHA-256-PLUS and XOAUTH2 are
+	// enabled. PLAIN and LOGIN are always offered, while the others are
+	// only offered if the Handler implements CRAMSecretProvider,
+	// CertificateAuthenticator, TokenAuthenticator or
+	// SCRAMCredentialsProvider respectively. In addition, EXTERNAL needs
+	// a verified TLS client certificate and the -PLUS variants need a TLS
+	// connection supporting channel binding. Set to an empty map to
+	// disable the AUTH command altogether.
+	SASLMechanisms map[string]SASLMechanism
+
+	// Commands maps upper-case names of custom commands to their
+	// definitions. A command registered under the name of a built-in one
+	// (e.g. "TOP") replaces it, and a nil entry disables it. Neither the
+	// map nor the commands may be modified once Serve has been called.
+	Commands map[string]*Command
+
+	// MaxSessions limits the number of concurrent sessions. Connections
+	// exceeding the limit are rejected before OnNewConnection is called.
+	// Zero means no limit.
+	MaxSessions int
+
+	// MaxSessionsPerIP limits the number of concurrent sessions from a
+	// single IP address. Connections exceeding the limit are rejected
+	// before OnNewConnection is called. Zero means no limit.
+	MaxSessionsPerIP int
+
+	// AcceptQueueSize limits the number of accepted connections for which
+	// OnNewConnection has not yet returned. Once the limit is reached the
+	// server stops accepting new connections until one of the handlers is
+	// ready, leaving further clients in the operating system's backlog.
+	// Zero means no limit.
+	AcceptQueueSize int
+
+	// OnConnectionRejected is an optional callback invoked whenever the
+	// server rejects a connection, along with the reason for doing so
+	// (e.g. ErrTooManySessions).
+	OnConnectionRejected func(peer net.Addr, reason error)
+
+	// bannerCounter makes sure that no two banners are the same, even if
+	// generated at the very same moment.
+	bannerCounter uint64
+
+	// lastSessionID is used (atomically) to assign session IDs.
+	lastSessionID uint64
+
+	// expireDays is the parsed Expire policy.
+	expireDays int
+
+	// apopReplays remembers APOP digests used within APOPReplayWindow.
+	apopReplays *replayCache
+
+	// inShutdown is set (atomically) once Shutdown or Close are called.
+	inShutdown int32
+
+	// setupOnce guards verifying settings and applying defaults, with the
+	// outcome of the former kept in setupErr.
+	setupOnce sync.Once
+	setupErr  error
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	sessions  map[uint64]*session
+
+	// acceptQueue is a semaphore enforcing AcceptQueueSize.
+	acceptQueue chan struct{}
+
+	// done is closed when the server starts shutting down.
+	done chan struct{}
+
+	// connections and peerConnections count connections admitted by the
+	// server, in total and per peer IP address respectively.
+	connections     int
+	peerConnections map[string]int
 }
 
 // Serve takes a net.Listener and starts processing incoming requests. Please
-// note that Server does not implement STARTTLS so unless your Listener
-// implements TLS (see package crypto/tls in the standard library) all
-// communications happen in plaintext. You have been warned.
+// note that unless your Listener implements TLS (see package crypto/tls in the
+// standard library) or TLSConfig is set and the client chooses to issue the
+// STLS command, all communications happen in plaintext. You have been warned.
 func (s *Server) Serve(listener net.Listener) error {
-	if err := s.verifySettings(); err != nil {
-		return err
+	// Settings are verified and defaults applied only once, no matter how
+	// many listeners the server is serving, so that all sessions share the
+	// same state (e.g. the APOP replay cache).
+	s.setupOnce.Do(func() {
+		if s.setupErr = s.verifySettings(); s.setupErr == nil {
+			s.applyDefaults()
+		}
+	})
+	if s.setupErr != nil {
+		return s.setupErr
 	}
-	s.calculateCapabilities()
+	if !s.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
 	for {
+		if !s.acquireAcceptSlot() {
+			return ErrServerClosed
+		}
 		conn, err := listener.Accept()
-		if err != nil && s.handleAcceptError(err) != nil {
-			return err
+		if err != nil {
+			s.releaseAcceptSlot()
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if err := s.handleAcceptError(err); err != nil {
+				return err
+			}
+			continue
 		}
 		s.serveOne(conn)
 	}
 }
 
+// Shutdown gracefully shuts down the server. It first closes all listeners so
+// that no new connections are accepted, then lets all sessions finish the
+// command they are currently processing, informs the clients that the server
+// is going away and waits until all connections are closed (and maildrops
+// unlocked). If the context expires before that happens, Shutdown
+// returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		sess.interrupt()
+	}
+	s.mu.Unlock()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.activeConnections() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.cancelSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and all client connections. The
+// sessions will still unlock their maildrops but Close does not wait for
+// that to happen. For a graceful shutdown use Shutdown.
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		sess.cancel()
+		sess.rawConn.Close()
+	}
+	return err
+}
+
+// cancelSessions cancels the contexts of all active sessions without closing
+// their connections.
+func (s *Server) cancelSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		sess.cancel()
+	}
+}
+
+// closeListeners puts the server in shutdown mode and closes all its
+// listeners, returning the first error encountered.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.shuttingDown() {
+		atomic.StoreInt32(&s.inShutdown, 1)
+		close(s.doneChan())
+	}
+	var err error
+	for listener := range s.listeners {
+		if cErr := listener.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		delete(s.listeners, listener)
+	}
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+// doneChan returns the channel closed when the server starts shutting down.
+// It must be called with s.mu held.
+func (s *Server) doneChan() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+// acquireAcceptSlot waits until the number of connections waiting for their
+// handlers drops below AcceptQueueSize. It returns false if the server
+// started shutting down in the meantime.
+func (s *Server) acquireAcceptSlot() bool {
+	if s.acceptQueue == nil {
+		return true
+	}
+	s.mu.Lock()
+	done := s.doneChan()
+	s.mu.Unlock()
+	select {
+	case s.acceptQueue <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// releaseAcceptSlot frees the slot taken by acquireAcceptSlot.
+func (s *Server) releaseAcceptSlot() {
+	if s.acceptQueue != nil {
+		<-s.acceptQueue
+	}
+}
+
+// trackListener adds or removes a listener from the set closed on shutdown.
+// It returns false if the server is already shutting down.
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, listener)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
 func (s *Server) handleAcceptError(err error) error {
 	if ne, ok := err.(net.Error); ok && ne.Temporary() {
 		time.Sleep(time.Second)
@@ -68,53 +377,144 @@ func (s *Server) handleAcceptError(err error) error {
 }
 
 func (s *Server) verifySettings() error {
-	if s.OnNewConnection == nil {
-		return errors.New("new connection callback not be nil")
+	var handlerSources int
+	if s.OnNewConnection != nil {
+		handlerSources++
+	}
+	if s.OnNewSession != nil {
+		handlerSources++
+	}
+	if s.Backend != nil {
+		handlerSources++
+	}
+	if handlerSources != 1 {
+		return errors.New("exactly one of OnNewConnection, OnNewSession and Backend must be set")
 	}
 	if s.Timeout < 10*time.Minute {
 		return errors.New("at least 10 minutes timeout required")
 	}
+	if s.Expire != "" {
+		if _, err := parseExpire(s.Expire); err != nil {
+			return err
+		}
+	}
+	for name, cmd := range s.Commands {
+		if cmd == nil {
+			continue // built-in command disabled
+		}
+		if err := cmd.verify(name); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (s *Server) serveOne(conn net.Conn) {
-	handler := s.OnNewConnection(conn.RemoteAddr())
-	if handler == nil {
+	if s.AccessControl != nil && !s.AccessControl.allowPeer(conn.RemoteAddr()) {
+		s.releaseAcceptSlot()
+		go s.reject(conn, ErrAddressDenied)
+		return
+	}
+	if err := s.admit(conn.RemoteAddr()); err != nil {
+		s.releaseAcceptSlot()
+		go s.reject(conn, err)
+		return
+	}
+	go s.startSession(conn)
+}
+
+// startSession obtains a handler for an admitted connection and serves the
+// session. It runs on a per-connection goroutine so that slow handler
+// construction does not hold up other connections.
+func (s *Server) startSession(conn net.Conn) {
+	sess := newSession(s, conn)
+	sess.handler = s.newHandler(sess.ctx, conn.RemoteAddr())
+	s.releaseAcceptSlot()
+	if sess.handler == nil {
 		// This must have been a conscious decision on the
 		// part of the HandlerFactory so not treating that as
 		// an error. In fact, not even logging it since the
 		// OnNewConnection callback is perfectly capable of
 		// doing that.
+		sess.cancel()
+		s.release(conn.RemoteAddr())
+		conn.Close()
 		return
 	}
-	go newSession(s, handler, conn).serve()
+	if !s.trackSession(sess) {
+		sess.cancel()
+		s.release(conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	sess.serve()
 }
 
-func (s *Server) calculateCapabilities() {
+// newHandler produces a handler for a new session using whichever callback or
+// Backend has been provided. It returns nil if the callback refused to do so.
+func (s *Server) newHandler(ctx context.Context, peer net.Addr) ContextHandler {
+	if s.Backend != nil {
+		return &backendAdapter{backend: s.Backend}
+	}
+	if s.OnNewSession != nil {
+		return s.OnNewSession(ctx, peer)
+	}
+	if handler := s.OnNewConnection(peer); handler != nil {
+		return NewContextHandler(handler)
+	}
+	return nil
+}
+
+func (s *Server) applyDefaults() {
 	s.Expire = withDefault(s.Expire, "NEVER")
+	s.expireDays, _ = parseExpire(s.Expire)
+	if s.UserStates == nil {
+		s.UserStates = NewMemoryUserStateStore()
+	}
+	if s.ExactSizes && s.SizeStore == nil {
+		s.SizeStore = NewMemorySizeStore()
+	}
+	if s.AuthThrottle != nil {
+		s.AuthThrottle.applyDefaults()
+	}
 	s.Implementation = withDefault(s.Implementation, "popart")
-	s.capabilities = capabilities(s.Expire, s.Implementation)
+	if s.SASLMechanisms == nil {
+		s.SASLMechanisms = defaultSASLMechanisms()
+	}
+	if s.APOPReplayWindow > 0 {
+		s.apopReplays = newReplayCache(s.APOPReplayWindow)
+	}
+	if s.AcceptQueueSize > 0 && s.acceptQueue == nil {
+		s.acceptQueue = make(chan struct{}, s.AcceptQueueSize)
+	}
 }
 
-// getBanner is only relevant within the context of an APOP exchange.
-func (s *Server) getBanner() string {
+// getBanner is only relevant within the context of APOP and CRAM-MD5
+// exchanges. As per RFC 1939 the timestamp must be different each time so
+// apart from the process ID and clock it includes a monotonic counter and a
+// random nonce.
+func (s *Server) getBanner() (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
 	return fmt.Sprintf(
-		"<%d.%d@%s>",
+		"<%d.%d.%d.%x@%s>",
 		os.Getpid(),
 		time.Now().Unix(),
+		atomic.AddUint64(&s.bannerCounter, 1),
+		nonce,
 		s.Hostname,
-	)
+	), nil
 }
 
-func capabilities(expire, implementation string) []string {
-	return []string{
-		"TOP",
-		"USER", // TODO: this should be factored out.
-		"PIPELINING",
-		fmt.Sprintf("%s %s", "EXPIRE", expire),
-		"UIDL",
-		fmt.Sprintf("%s %s", "IMPLEMENTATION", implementation),
+// isReplayedAPOP reports whether an APOP digest has already been used within
+// the replay window.
+func (s *Server) isReplayedAPOP(hexdigest string) bool {
+	if s.apopReplays == nil {
+		return false
 	}
+	return s.apopReplays.check(strings.ToLower(hexdigest))
 }
 
 func withDefault(value, fallback string) string {
@@ -0,0 +1,455 @@
+package popart
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener is a net.Listener handing out in-memory connections created
+// with net.Pipe.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr("server")
+}
+
+func (l *pipeListener) dial(t *testing.T) *testClient {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not accept the connection")
+	}
+	return newTestClient(t, client)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// testClient is the client side of a POP3 session.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *textproto.Reader
+	writer *textproto.Writer
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{
+		t:      t,
+		conn:   conn,
+		reader: textproto.NewReader(bufio.NewReader(conn)),
+		writer: textproto.NewWriter(bufio.NewWriter(conn)),
+	}
+}
+
+// line reads a single line of the server's response.
+func (c *testClient) line() string {
+	c.t.Helper()
+	line, err := c.reader.ReadLine()
+	if err != nil {
+		c.t.Fatalf("reading response: %v", err)
+	}
+	return line
+}
+
+// lines reads the rest of a multi-line response.
+func (c *testClient) lines() []string {
+	c.t.Helper()
+	lines, err := c.reader.ReadDotLines()
+	if err != nil {
+		c.t.Fatalf("reading multi-line response: %v", err)
+	}
+	return lines
+}
+
+// cmd sends a command and returns the first line of the response.
+func (c *testClient) cmd(format string, args ...interface{}) string {
+	c.t.Helper()
+	if err := c.writer.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("sending command: %v", err)
+	}
+	return c.line()
+}
+
+// expect sends a command and fails the test unless the response starts with
+// the given prefix.
+func (c *testClient) expect(prefix, format string, args ...interface{}) string {
+	c.t.Helper()
+	line := c.cmd(format, args...)
+	if !strings.HasPrefix(line, prefix) {
+		c.t.Fatalf("%q: got %q, expected %q", format, line, prefix)
+	}
+	return line
+}
+
+// expectClosed fails the test unless the server has closed the connection.
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	if line, err := c.reader.ReadLine(); err == nil {
+		c.t.Fatalf("expected connection to be closed, got %q", line)
+	}
+}
+
+// login reads the greeting and authenticates with USER and PASS.
+func (c *testClient) login(username, password string) string {
+	c.t.Helper()
+	c.line()
+	c.expect("+OK", "USER %s", username)
+	return c.cmd("PASS %s", password)
+}
+
+// serveTest starts serving on a new pipeListener and shuts the server down
+// once the test is over.
+func serveTest(t *testing.T, srv *Server) *pipeListener {
+	if srv.Timeout == 0 {
+		srv.Timeout = 10 * time.Minute
+	}
+	listener := newPipeListener()
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(listener) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return listener
+}
+
+// testMailbox is an in-memory Mailbox.
+type testMailbox struct {
+	mu       sync.Mutex
+	messages []string
+	deleted  []uint64
+	locks    int
+	unlocks  int
+	reads    int
+}
+
+func (m *testMailbox) Lock(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks++
+	return nil
+}
+
+func (m *testMailbox) Unlock(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unlocks++
+	return nil
+}
+
+func (m *testMailbox) DeleteMessages(ctx context.Context, numbers []uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, numbers...)
+	return nil
+}
+
+func (m *testMailbox) GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+	return ioutil.NopCloser(strings.NewReader(m.messages[number-1])), nil
+}
+
+func (m *testMailbox) GetMessageCount(ctx context.Context) (uint64, error) {
+	return uint64(len(m.messages)), nil
+}
+
+func (m *testMailbox) GetMessageID(ctx context.Context, number uint64) (string, error) {
+	return strings.Repeat("x", int(number)), nil
+}
+
+func (m *testMailbox) GetMessageSize(ctx context.Context, number uint64) (uint64, error) {
+	return uint64(len(m.messages[number-1])), nil
+}
+
+func (m *testMailbox) readCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reads
+}
+
+func (m *testMailbox) lockCounts() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.locks, m.unlocks
+}
+
+// testBackend is a Backend with a single user "alice" whose password is
+// "secret".
+type testBackend struct {
+	mailbox *testMailbox
+}
+
+func newTestBackend(messages ...string) *testBackend {
+	return &testBackend{mailbox: &testMailbox{messages: messages}}
+}
+
+func (b *testBackend) Login(ctx context.Context, username, password string) (Mailbox, error) {
+	if username != "alice" || password != "secret" {
+		return nil, NewReportableError("invalid credentials")
+	}
+	return b.mailbox, nil
+}
+
+func (b *testBackend) Mailbox(ctx context.Context, username string) (Mailbox, error) {
+	if username != "alice" {
+		return nil, NewReportableError("no such user")
+	}
+	return b.mailbox, nil
+}
+
+func TestBackendSessionEndingBeforeLogin(t *testing.T) {
+	backend := newTestBackend("Subject: test\r\n\r\nhello\r\n")
+	srv := &Server{
+		Backend:      backend,
+		AuthThrottle: &AuthThrottle{MaxSessionFailures: 1},
+	}
+	listener := serveTest(t, srv)
+
+	quitter := listener.dial(t)
+	quitter.line()
+	quitter.expect("+OK", "QUIT")
+	quitter.expectClosed()
+
+	dropper := listener.dial(t)
+	dropper.line()
+	dropper.conn.Close()
+
+	failing := listener.dial(t)
+	failing.line()
+	failing.expect("+OK", "USER alice")
+	failing.expect("-ERR", "PASS wrong")
+	failing.expectClosed()
+
+	// The server must still be alive and unlock only what it locked.
+	client := listener.dial(t)
+	if line := client.login("alice", "secret"); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("login failed: %q", line)
+	}
+	client.expect("+OK", "QUIT")
+	client.expectClosed()
+	if locks, unlocks := backend.mailbox.lockCounts(); locks != 1 || unlocks != 1 {
+		t.Errorf("got %d locks and %d unlocks, expected one each", locks, unlocks)
+	}
+}
+
+func TestServingMultipleListeners(t *testing.T) {
+	srv := &Server{Backend: newTestBackend("hello\r\n"), APOP: true, APOPReplayWindow: time.Hour}
+	first := serveTest(t, srv)
+	first.dial(t).line()
+	replays := srv.apopReplays
+	second := newPipeListener()
+	go srv.Serve(second)
+	second.dial(t).line()
+	if srv.apopReplays != replays {
+		t.Error("serving another listener replaced the APOP replay cache")
+	}
+}
+
+func TestBackendRefusedLoginKeepsBackendInterfaces(t *testing.T) {
+	access := &AccessControl{}
+	users := map[string]AccessRules{"alice": {Allow: []string{"192.0.2.0/24"}}}
+	if err := access.Reload(AccessRules{}, users); err != nil {
+		t.Fatal(err)
+	}
+	listener := serveTest(t, &Server{Backend: newSASLBackend(), AccessControl: access})
+	client := listener.dial(t)
+	client.line()
+	client.expect("+OK", "USER alice")
+	client.expect("-ERR [AUTH]", "PASS secret")
+	client.expect("+OK", "CAPA")
+	for _, line := range client.lines() {
+		if strings.HasPrefix(line, "SASL ") {
+			if !strings.Contains(line, " SCRAM-SHA-256") {
+				t.Errorf("SCRAM no longer offered after a refused login: %q", line)
+			}
+			return
+		}
+	}
+	t.Error("SASL no longer offered after a refused login")
+}
+
+func TestCredentialFailuresCarryAuthCode(t *testing.T) {
+	listener := serveTest(t, &Server{Backend: newTestBackend(), APOP: true})
+	client := listener.dial(t)
+	client.line()
+	client.expect("+OK", "USER alice")
+	client.expect("-ERR [AUTH] invalid credentials", "PASS wrong")
+	client.expect("-ERR [AUTH] invalid credentials", "AUTH PLAIN %s", plainResponse("alice", "wrong"))
+	client.expect("-ERR [SYS/PERM] APOP not supported", "APOP alice 0123456789abcdef0123456789abcdef")
+}
+
+// waitFor polls the condition until it holds or the test times out.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownLetsIdleSessionsGo(t *testing.T) {
+	backend := newTestBackend("hello\r\n")
+	srv := &Server{Backend: backend, Timeout: 10 * time.Minute}
+	listener := newPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	client := listener.dial(t)
+	client.login("alice", "secret")
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	if line := client.line(); line != "-ERR "+errShuttingDown.Error() {
+		t.Errorf("got %q, expected the shutdown notice", line)
+	}
+	client.expectClosed()
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	if locks, unlocks := backend.mailbox.lockCounts(); locks != 1 || unlocks != 1 {
+		t.Errorf("got %d locks and %d unlocks, expected one each", locks, unlocks)
+	}
+	if err := srv.Serve(newPipeListener()); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownCancelsSessionsWhenOutOfTime(t *testing.T) {
+	backend := newBlockingBackend()
+	srv := &Server{Backend: backend, Timeout: 10 * time.Minute}
+	listener := newPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "RETR 1")
+	<-backend.mailbox.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	<-backend.mailbox.cancelled
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	srv.Close()
+	client.expectClosed()
+}
+
+func TestCloseDropsConnections(t *testing.T) {
+	backend := newTestBackend()
+	srv := &Server{Backend: backend}
+	listener := serveTest(t, srv)
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	client.expectClosed()
+	waitFor(t, "the maildrop to be unlocked", func() bool {
+		_, unlocks := backend.mailbox.lockCounts()
+		return unlocks == 1
+	})
+}
+
+// slowSessions builds handlers for connections from 192.0.2.1 only once
+// released, and right away for everyone else.
+type slowSessions struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowSessions() *slowSessions {
+	return &slowSessions{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (s *slowSessions) newSession(ctx context.Context, peer net.Addr) ContextHandler {
+	if peerIP(peer) == "192.0.2.1" {
+		close(s.started)
+		<-s.release
+	}
+	return &backendAdapter{backend: newTestBackend()}
+}
+
+func TestSlowHandlerDoesNotHoldUpOthers(t *testing.T) {
+	slow := newSlowSessions()
+	defer close(slow.release)
+	listener := serveTest(t, &Server{OnNewSession: slow.newSession})
+	listener.dialFrom(t, "192.0.2.1:1000")
+	<-slow.started
+	other := listener.dialFrom(t, "192.0.2.2:1000")
+	other.line()
+	other.expect("+OK", "CAPA")
+}
+
+func TestAcceptQueueSize(t *testing.T) {
+	slow := newSlowSessions()
+	listener := serveTest(t, &Server{OnNewSession: slow.newSession, AcceptQueueSize: 1})
+	waiting := listener.dialFrom(t, "192.0.2.1:1000")
+	<-slow.started
+
+	server, client := net.Pipe()
+	select {
+	case listener.conns <- &addrConn{Conn: server, remote: pipeAddr("192.0.2.2:1000")}:
+		t.Fatal("connection accepted while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(slow.release)
+	waiting.line()
+	select {
+	case listener.conns <- &addrConn{Conn: server, remote: pipeAddr("192.0.2.2:1000")}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted once the queue has room")
+	}
+	newTestClient(t, client).line()
+}
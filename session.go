@@ -2,12 +2,19 @@ package popart
 
 import (
 	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,11 +25,19 @@ const (
 	stateTerminateConnection
 )
 
+// stateNames maps session states to their names used in RFC 1939.
+var stateNames = map[int]string{
+	stateAuthorization: "AUTHORIZATION",
+	stateTransaction:   "TRANSACTION",
+	stateUpdate:        "UPDATE",
+}
+
 type operationHandler func(s *session, args []string) error
 
 var (
 	operationHandlers = map[string]operationHandler{
 		"APOP": (*session).handleAPOP,
+		"AUTH": (*session).handleAUTH,
 		"CAPA": (*session).handleCAPA,
 		"DELE": (*session).handleDELE,
 		"LIST": (*session).handleLIST,
@@ -32,6 +47,7 @@ var (
 		"RETR": (*session).handleRETR,
 		"RSET": (*session).handleRSET,
 		"STAT": (*session).handleSTAT,
+		"STLS": (*session).handleSTLS,
 		"TOP":  (*session).handleTOP,
 		"UIDL": (*session).handleUIDL,
 		"USER": (*session).handleUSER,
@@ -40,46 +56,101 @@ var (
 
 type session struct {
 	server  *Server
-	handler Handler
+	handler ContextHandler
 	conn    net.Conn
 
+	// ctx is passed to all handler calls and cancelled once the session
+	// is over.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// rawConn is the connection the session was started with. Unlike conn
+	// it is not replaced by STLS so it is safe to use from other
+	// goroutines.
+	rawConn net.Conn
+
+	id         uint64
+	started    time.Time
+	bytesSent  uint64 // accessed atomically
+	terminated int32  // accessed atomically
+
+	// status is the part of the session state visible to other goroutines
+	// through the Server's Sessions method.
+	statusMu sync.Mutex
+	status   sessionStatus
+
 	state         int
+	locked        bool // whether the maildrop has been locked
+	banner        string
 	username      string
+	authFailures  int
+	saslUser      string // identified by the current SASL exchange
 	markedDeleted map[uint64]struct{}
 	msgSizes      map[uint64]uint64
+	msgIDs        map[uint64]string
+
+	// expired are messages hidden because of the EXPIRE policy and
+	// retrieved are the ones the client has retrieved with RETR.
+	expired   map[uint64]struct{}
+	retrieved map[uint64]struct{}
 
 	reader *textproto.Reader
 	writer *textproto.Writer
 }
 
-func newSession(server *Server, handler Handler, conn net.Conn) *session {
-	return &session{
+func newSession(server *Server, conn net.Conn) *session {
+	ret := &session{
 		server:        server,
-		handler:       handler,
-		conn:          conn,
+		rawConn:       conn,
+		id:            atomic.AddUint64(&server.lastSessionID, 1),
+		started:       time.Now(),
 		markedDeleted: make(map[uint64]struct{}),
 		msgSizes:      make(map[uint64]uint64),
-		reader:        textproto.NewReader(bufio.NewReader(conn)),
-		writer:        textproto.NewWriter(bufio.NewWriter(conn)),
-	}
+		msgIDs:        make(map[uint64]string),
+		expired:       make(map[uint64]struct{}),
+		retrieved:     make(map[uint64]struct{}),
+	}
+	ctx := context.WithValue(context.Background(), peerAddrKey, conn.RemoteAddr())
+	ctx = context.WithValue(ctx, sessionIDKey, ret.id)
+	ret.ctx, ret.cancel = context.WithCancel(ctx)
+	ret.setConn(conn)
+	return ret
+}
+
+// setConn makes the session communicate over the provided connection. Any
+// input buffered from the previous connection is discarded.
+func (s *session) setConn(conn net.Conn) {
+	s.conn = conn
+	s.reader = textproto.NewReader(bufio.NewReader(conn))
+	s.writer = textproto.NewWriter(bufio.NewWriter(&countingWriter{
+		writer: conn,
+		count:  &s.bytesSent,
+	}))
 }
 
 // serve method handles the entire session which after the first message from
 // the server is a series of command-response interactions.
 func (s *session) serve() {
-	defer s.conn.Close()
+	defer s.server.untrackSession(s)
+	defer s.cancel()
+	defer s.closeConn()
 	defer s.unlock() // unlock maildrop if locked no matter what
 	helloParts := []string{"POP3 server ready"}
 	if s.server.APOP {
-		banner := s.server.getBanner()
-		helloParts = append(helloParts, banner)
-		if err := s.handler.SetBanner(banner); err != nil {
-			s.handler.HandleSessionError(err)
+		banner, err := s.server.getBanner()
+		if err != nil {
+			s.reportError(err)
+			return
+		}
+		s.banner = banner
+		helloParts = append(helloParts, s.banner)
+		if err := s.handler.SetBanner(s.ctx, s.banner); err != nil {
+			s.reportError(err)
 			return // go home handler, you're drunk!
 		}
 	}
 	if err := s.respondOK(strings.Join(helloParts, " ")); err != nil {
-		s.handler.HandleSessionError(err)
+		s.reportError(err)
 		return // communication problem, most likely?
 	}
 	for {
@@ -100,31 +171,79 @@ func (s *session) serveOne() bool {
 	if err := s.conn.SetReadDeadline(readBy); err != nil {
 		return s.handleError(err, false)
 	}
+	// The server may have started shutting down after the previous command.
+	// Checking this only after setting the deadline above guarantees that
+	// the interrupt will not be missed.
+	if s.server.shuttingDown() {
+		return s.handleError(errShuttingDown, false)
+	}
 	line, err := s.reader.ReadLine()
+	if err != nil && s.server.shuttingDown() {
+		return s.handleError(errShuttingDown, false)
+	}
 	if err != nil {
 		return s.handleError(err, false) // communication problem, most likely?
 	}
 	args := strings.Split(line, " ")
 	command := strings.ToUpper(args[0])
-	cmdValidator, exists := validators[command]
+	cmdValidator, cmdHandler, exists := s.server.lookupCommand(command)
 	if !exists {
 		return s.handleError(errInvalidSyntax, true) // unknown command
 	}
 	if err := cmdValidator.validate(s, args[1:]); err != nil {
 		return s.handleError(err, true)
 	}
-	return s.handleError(operationHandlers[command](s, args[1:]), true)
+	s.publishStatus(command)
+	defer s.publishStatus("")
+	if command != "AUTH" && command != "STLS" && command != "QUIT" {
+		defer s.watchConnection()()
+	}
+	return s.handleError(cmdHandler(s, args[1:]), true)
+}
+
+// watchConnection cancels the session's context if the client disconnects
+// while a command is being handled, so that the handler can give up on any
+// expensive work. The returned function stops watching and must be called
+// before reading from the client again. Commands reading from the client
+// themselves can not be watched, and neither is QUIT: once the client issues
+// it the UPDATE state must be completed even if the client goes away without
+// waiting for the response (RFC 1939, page 10).
+func (s *session) watchConnection() (stop func()) {
+	var stopped int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peeking does not consume any input the client may have
+		// pipelined after the current command.
+		_, err := s.reader.R.Peek(1)
+		if err == nil || atomic.LoadInt32(&stopped) == 1 {
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return // inactivity timeout or shutdown, not a disconnect
+		}
+		s.cancel()
+	}()
+	return func() {
+		atomic.StoreInt32(&stopped, 1)
+		s.conn.SetReadDeadline(time.Now()) // wakes up the watcher
+		<-done
+	}
 }
 
 // handleCAPA is a callback for capability listing.
 // RFC 2449, page 2.
 func (s *session) handleCAPA(args []string) error {
+	capabilities, err := s.capabilities()
+	if err != nil {
+		return err
+	}
 	if err := s.respondOK("Capability list follows"); err != nil {
 		return err
 	}
 	dotWriter := s.writer.DotWriter()
 	defer s.closeOrReport(dotWriter)
-	for _, capability := range s.server.capabilities {
+	for _, capability := range capabilities {
 		if _, err := fmt.Fprintln(dotWriter, capability); err != nil {
 			return err
 		}
@@ -132,18 +251,108 @@ func (s *session) handleCAPA(args []string) error {
 	return nil
 }
 
+// capabilities calculates the set of things the server can announce to the
+// client upon receiving the CAPA command. The list depends on the server
+// settings as well as on the state of this particular connection. Once the
+// user is authenticated, the handler may adjust it to reflect per-user
+// settings.
+// RFC 2449, page 3.
+func (s *session) capabilities() ([]string, error) {
+	var ret []string
+	if s.server.hasCommand("TOP") {
+		ret = append(ret, "TOP")
+	}
+	ret = append(ret, s.authCapabilities()...)
+	ret = append(
+		ret,
+		"PIPELINING",
+		fmt.Sprintf("%s %s", "EXPIRE", s.server.Expire),
+	)
+	if s.server.LoginDelay > 0 {
+		ret = append(ret, fmt.Sprintf("%s %d", "LOGIN-DELAY", int(s.server.LoginDelay/time.Second)))
+	}
+	if s.server.hasCommand("UIDL") {
+		ret = append(ret, "UIDL")
+	}
+	ret = append(
+		ret,
+		"RESP-CODES",
+		"AUTH-RESP-CODE",
+		fmt.Sprintf("%s %s", "IMPLEMENTATION", s.server.Implementation),
+	)
+	ret = append(ret, s.server.commandCapabilities()...)
+	if s.state == stateAuthorization {
+		return ret, nil
+	}
+	if provider, ok := unwrapHandler(s.handler).(CapabilityProvider); ok {
+		return provider.Capabilities(s.ctx, ret)
+	}
+	return ret, nil
+}
+
+// authCapabilities returns capabilities related to authentication, which are
+// only announced before the user is authenticated.
+func (s *session) authCapabilities() []string {
+	if s.state != stateAuthorization {
+		return nil
+	}
+	var ret []string
+	if !s.server.RequireTLS || s.isTLS() {
+		if s.server.hasCommand("USER") {
+			ret = append(ret, "USER")
+		}
+		if mechanisms := s.saslMechanisms(); len(mechanisms) > 0 && s.server.hasCommand("AUTH") {
+			ret = append(ret, "SASL "+strings.Join(mechanisms, " "))
+		}
+	}
+	if s.server.TLSConfig != nil && !s.isTLS() && s.server.hasCommand("STLS") {
+		ret = append(ret, "STLS")
+	}
+	return ret
+}
+
 // handleAPOP is a callback for an APOP authentication mechanism.
 // RFC 1939, page 15.
 func (s *session) handleAPOP(args []string) error {
 	if !s.server.APOP {
 		return NewReportableError("server does not support APOP")
 	}
-	if err := s.handler.AuthenticateAPOP(args[0], args[1]); err != nil {
+	if err := s.checkAuthLockout(args[0]); err != nil {
 		return err
 	}
+	if err := s.authenticateAPOP(args[0], args[1]); err != nil {
+		return s.authFailed(args[0], err)
+	}
+	if err := s.authSucceeded(args[0]); err != nil {
+		return err
+	}
+	s.username = args[0]
 	return s.signIn()
 }
 
+// authenticateAPOP verifies the APOP digest itself if the handler is able to
+// provide the shared secret or delegates the verification to the handler
+// otherwise.
+func (s *session) authenticateAPOP(username, hexdigest string) error {
+	if s.server.isReplayedAPOP(hexdigest) {
+		return errAPOPReplayed
+	}
+	provider, ok := unwrapHandler(s.handler).(APOPSecretProvider)
+	if !ok {
+		return s.handler.AuthenticateAPOP(s.ctx, username, hexdigest)
+	}
+	secret, err := provider.GetAPOPSecret(s.ctx, username)
+	if err != nil {
+		return err
+	}
+	digest := md5.Sum([]byte(s.banner + secret))
+	expected := hex.EncodeToString(digest[:])
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(hexdigest)), []byte(expected)) != 1 {
+		return errAuthFailed
+	}
+	return provider.Authorize(s.ctx, username)
+}
+
 // handleDELE is a callback for a single message deletion.
 // RFC 1939, page 8.
 func (s *session) handleDELE(args []string) error {
@@ -161,7 +370,7 @@ func (s *session) handleLIST(args []string) error {
 			return s.respondOK("%d %d", msgId, s.msgSizes[msgId])
 		})
 	}
-	return s.forEachMessage(func(msgId uint64) (string, error) {
+	return s.forEachMessage("scan listing follows", func(msgId uint64) (string, error) {
 		return fmt.Sprintf("%d %d", msgId, s.msgSizes[msgId]), nil
 	})
 }
@@ -180,7 +389,13 @@ func (s *session) handlePASS(args []string) error {
 	if s.username == "" {
 		return NewReportableError("please provide username first")
 	}
-	if err := s.handler.AuthenticatePASS(s.username, args[0]); err != nil {
+	if err := s.checkAuthLockout(s.username); err != nil {
+		return err
+	}
+	if err := s.handler.AuthenticatePASS(s.ctx, s.username, args[0]); err != nil {
+		return s.authFailed(s.username, err)
+	}
+	if err := s.authSucceeded(s.username); err != nil {
 		return err
 	}
 	return s.signIn()
@@ -198,13 +413,20 @@ func (s *session) handleQUIT(args []string) error {
 		return bye()
 	}
 	s.state = stateUpdate // so that no future calls will succeed
-	var delMsg []uint64
-	for key := range s.markedDeleted {
-		delMsg = append(delMsg, key)
+	delMsg := s.messagesToDelete()
+	deletedIDs, retrievedIDs, err := s.updateIDs(delMsg)
+	if err != nil {
+		return err
 	}
-	if err := s.handler.DeleteMessages(delMsg); err != nil {
+	if err := s.handler.DeleteMessages(s.ctx, delMsg); err != nil {
 		return err
 	}
+	if err := s.updateRetrievals(deletedIDs, retrievedIDs); err != nil {
+		s.reportError(err) // messages are gone already, no use failing now
+	}
+	if err := s.forgetSizes(deletedIDs); err != nil {
+		s.reportError(err)
+	}
 	return bye()
 }
 
@@ -216,15 +438,27 @@ func (s *session) handleRETR(args []string) (err error) {
 		if err := s.respondOK("%d octets", s.msgSizes[msgId]); err != nil {
 			return err
 		}
-		readCloser, err := s.handler.GetMessageReader(msgId)
+		readCloser, err := s.handler.GetMessageReader(s.ctx, msgId)
 		if err != nil {
 			return err
 		}
 		defer s.closeOrReport(readCloser)
 		dotWriter := s.writer.DotWriter()
 		defer s.closeOrReport(dotWriter)
-		_, err = io.Copy(dotWriter, readCloser)
-		return err
+		if !s.server.ExactSizes {
+			if _, err = io.Copy(dotWriter, readCloser); err != nil {
+				return err
+			}
+			s.retrieved[msgId] = struct{}{}
+			return nil
+		}
+		counter := &octetCounter{}
+		if _, err = io.Copy(io.MultiWriter(dotWriter, counter), readCloser); err != nil {
+			return err
+		}
+		s.verifySize(msgId, counter)
+		s.retrieved[msgId] = struct{}{}
+		return nil
 	})
 }
 
@@ -234,6 +468,9 @@ func (s *session) handleRETR(args []string) (err error) {
 // RFC 1939, page 9.
 func (s *session) handleRSET(args []string) error {
 	s.markedDeleted = make(map[uint64]struct{})
+	for msgID := range s.expired {
+		s.markedDeleted[msgID] = struct{}{}
+	}
 	return s.respondOK(
 		"maildrop has %d messages (%d octets)",
 		s.getMessageCount(),
@@ -248,6 +485,33 @@ func (s *session) handleSTAT(args []string) error {
 	return s.respondOK("%d %d", s.getMessageCount(), s.getMaildropSize())
 }
 
+// handleSTLS is a callback for the client requesting the session to be
+// upgraded to TLS.
+// RFC 2595, page 5.
+func (s *session) handleSTLS(args []string) error {
+	if s.server.TLSConfig == nil {
+		return NewReportableError("server does not support STLS")
+	}
+	if s.isTLS() {
+		return NewReportableError("command not permitted when TLS active")
+	}
+	if err := s.respondOK("begin TLS negotiation"); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(s.conn, s.server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	// Replacing the reader throws away anything the client may have
+	// pipelined after the STLS command. That input was sent in plaintext
+	// and treating it as if it came over the secure channel would open
+	// the door to command injection attacks. For the same reason the
+	// username given with USER before the upgrade is forgotten.
+	s.setConn(tlsConn)
+	s.username, s.saslUser = "", ""
+	return nil
+}
+
 // handleTOP is a callback for the client requesting a number of lines from the
 // top of a single message.
 // RFC 1939, page 11.
@@ -260,39 +524,54 @@ func (s *session) handleTOP(args []string) error {
 		if err := s.writer.PrintfLine("+OK"); err != nil {
 			return err
 		}
-		readCloser, err := s.handler.GetMessageReader(msgId)
+		readCloser, err := s.handler.GetMessageReader(s.ctx, msgId)
 		if err != nil {
 			return err
 		}
 		defer s.closeOrReport(readCloser)
 		dotWriter := s.writer.DotWriter()
 		defer s.closeOrReport(dotWriter)
-		protoReader := textproto.NewReader(bufio.NewReader(readCloser))
-		for i := uint64(0); i < noLines; i++ {
-			line, readErr := protoReader.ReadLineBytes()
-			if err := printTopLine(line, readErr, dotWriter); err != nil {
-				return err
-			}
-		}
-		return nil
+		return writeTop(dotWriter, readCloser, noLines)
 	})
 }
 
-func printTopLine(line []byte, readErr error, writer io.Writer) error {
-	if readErr == io.EOF || readErr == nil {
-		if err := writeWithError(writer, line); err != nil {
+// writeTop copies the header block of a message, followed by the blank line
+// separating it from the body and at most bodyLines lines of the body.
+// Folded header lines are copied along with the rest of the headers and
+// lines may be terminated either with CRLF or with a bare LF. A message
+// without a body is copied as a whole.
+func writeTop(w io.Writer, r io.Reader, bodyLines uint64) error {
+	reader := bufio.NewReader(r)
+	inHeaders, lineStart := true, true
+	for {
+		if lineStart && !inHeaders {
+			if bodyLines == 0 {
+				return nil
+			}
+			bodyLines--
+		}
+		chunk, readErr := reader.ReadSlice('\n')
+		if lineStart && inHeaders && isEmptyLine(chunk) {
+			inHeaders = false
+		}
+		if _, err := w.Write(chunk); err != nil {
 			return err
 		}
+		switch readErr {
+		case nil:
+			lineStart = true
+		case bufio.ErrBufferFull:
+			lineStart = false // line longer than the buffer
+		case io.EOF:
+			return nil
+		default:
+			return readErr
+		}
 	}
-	if readErr != nil {
-		return readErr
-	}
-	return writeWithError(writer, []byte{'\n'})
 }
 
-func writeWithError(w io.Writer, content []byte) error {
-	_, err := w.Write(content)
-	return err
+func isEmptyLine(line []byte) bool {
+	return string(line) == "\n" || string(line) == "\r\n"
 }
 
 // handleUIDL is a callback for the client unique message identifiers for
@@ -301,15 +580,15 @@ func writeWithError(w io.Writer, content []byte) error {
 func (s *session) handleUIDL(args []string) (err error) {
 	if len(args) == 1 {
 		return s.withMessageDo(args[0], func(msgId uint64) error {
-			uidl, err := s.handler.GetMessageID(msgId)
+			uidl, err := s.getMessageID(msgId)
 			if err != nil {
 				return err
 			}
 			return s.respondOK("%d %s", msgId, uidl)
 		})
 	}
-	return s.forEachMessage(func(msgId uint64) (string, error) {
-		uidl, err := s.handler.GetMessageID(msgId)
+	return s.forEachMessage("unique-id listing follows", func(msgId uint64) (string, error) {
+		uidl, err := s.getMessageID(msgId)
 		if err != nil {
 			return "", err
 		}
@@ -341,7 +620,9 @@ func (s *session) handleError(err error, shouldContinue bool) bool {
 		}
 	}
 	s.state = stateTerminateConnection // will terminate the connection!
-	s.handler.HandleSessionError(err)
+	if atomic.LoadInt32(&s.terminated) == 0 {
+		s.reportError(err)
+	}
 	return shouldContinue
 }
 
@@ -356,12 +637,25 @@ func (s *session) respondOK(format string, args ...interface{}) error {
 // based on that builds maildrop statistics that are then cached internally
 // throughout the whole length of the session.
 func (s *session) fetchMaildropStats() error {
-	msgCount, err := s.handler.GetMessageCount()
+	if err := s.fetchMessageSizes(); err != nil {
+		return err
+	}
+	if s.server.ExactSizes {
+		return s.measureMessages()
+	}
+	return nil
+}
+
+func (s *session) fetchMessageSizes() error {
+	if lister, ok := unwrapHandler(s.handler).(MaildropLister); ok {
+		return s.listMaildrop(lister)
+	}
+	msgCount, err := s.handler.GetMessageCount(s.ctx)
 	if err != nil {
 		return err
 	}
 	for i := uint64(0); i < msgCount; i++ {
-		mSize, err := s.handler.GetMessageSize(i + 1)
+		mSize, err := s.handler.GetMessageSize(s.ctx, i+1)
 		if err != nil {
 			return err
 		}
@@ -370,17 +664,60 @@ func (s *session) fetchMaildropStats() error {
 	return nil
 }
 
+// listMaildrop builds maildrop statistics and possibly caches unique message
+// IDs using a single call to the handler.
+func (s *session) listMaildrop(lister MaildropLister) error {
+	sizes, ids, err := lister.ListMessages(s.ctx)
+	if err != nil {
+		return err
+	}
+	if ids != nil && len(ids) != len(sizes) {
+		return fmt.Errorf("got %d message IDs for %d messages", len(ids), len(sizes))
+	}
+	for i, size := range sizes {
+		s.msgSizes[uint64(i+1)] = size
+	}
+	for i, id := range ids {
+		s.msgIDs[uint64(i+1)] = id
+	}
+	return nil
+}
+
+// getMessageID returns the unique ID of a message, asking the handler only if
+// it is not already cached.
+func (s *session) getMessageID(msgID uint64) (string, error) {
+	if id, cached := s.msgIDs[msgID]; cached {
+		return id, nil
+	}
+	id, err := s.handler.GetMessageID(s.ctx, msgID)
+	if err != nil {
+		return "", err
+	}
+	s.msgIDs[msgID] = id
+	return id, nil
+}
+
 // signIn is called after successful authentication whereby the protocol
 // requires that the maildrop is not available to any other users trying to
 // access it concurrently (RFC 1939, page 3).
 func (s *session) signIn() error {
-	if err := s.handler.LockMaildrop(); err != nil {
+	if err := s.lockMaildrop(); err != nil {
+		if binder, ok := s.handler.(userBinder); ok {
+			binder.unbindUser()
+		}
 		return err
 	}
+	s.locked = true
 	s.state = stateTransaction
 	if err := s.fetchMaildropStats(); err != nil {
 		return err
 	}
+	if err := s.expireMessages(); err != nil {
+		return err
+	}
+	if err := s.recordLogin(); err != nil {
+		return err
+	}
 	return s.respondOK(
 		"%s's maildrop has %d messages (%d octets)",
 		s.username,
@@ -389,6 +726,23 @@ func (s *session) signIn() error {
 	)
 }
 
+// lockMaildrop checks whether the authenticated user may access their maildrop
+// now and locks it if so.
+func (s *session) lockMaildrop() error {
+	if err := s.checkUserAccess(); err != nil {
+		return err
+	}
+	if binder, ok := s.handler.(userBinder); ok {
+		if err := binder.bindUser(s.ctx, s.username); err != nil {
+			return err
+		}
+	}
+	if err := s.checkLoginDelay(); err != nil {
+		return err
+	}
+	return s.handler.LockMaildrop(s.ctx)
+}
+
 // getMessageCount reports the relevant number based on cached data.
 func (s *session) getMessageCount() uint64 {
 	return uint64(len(s.msgSizes) - len(s.markedDeleted))
@@ -407,8 +761,12 @@ func (s *session) getMaildropSize() uint64 {
 
 // forEachMessage is a helper that allows a callback to be invoked for every
 // message in the maildrop that is not deleted. The callback is expected to
-// return a line that is then printed out to the client.
-func (s *session) forEachMessage(fn func(id uint64) (string, error)) error {
+// return a line that is then printed out to the client, following a positive
+// response with the provided header.
+func (s *session) forEachMessage(header string, fn func(id uint64) (string, error)) error {
+	if err := s.respondOK(header); err != nil {
+		return err
+	}
 	dotWriter := s.writer.DotWriter()
 	defer s.closeOrReport(dotWriter)
 	for i := uint64(0); i < uint64(len(s.msgSizes)); i++ {
@@ -443,21 +801,108 @@ func (s *session) withMessageDo(sID string, fn func(id uint64) error) error {
 	return fn(msgID)
 }
 
-// unlock will unlock the client's maildrop if it is locked. Note that we assume
-// the mailbox is locked if the exchange proceeded past the authorization stage.
+// unlock will unlock the client's maildrop if it has been locked by signIn.
 func (s *session) unlock() {
-	if s.state == stateAuthorization {
+	if !s.locked {
 		return // we didn't yet even have a chance to lock the maildrop
 	}
-	if err := s.handler.UnlockMaildrop(); err != nil {
-		s.handler.HandleSessionError(err)
+	if err := s.handler.UnlockMaildrop(context.WithoutCancel(s.ctx)); err != nil {
+		s.reportError(err)
+	}
+}
+
+// isTLS reports whether the session is talking to the client over TLS, either
+// because the listener provided a TLS connection or because of a successful
+// STLS command.
+func (s *session) isTLS() bool {
+	_, ok := s.conn.(*tls.Conn)
+	return ok
+}
+
+// tlsState returns the state of the TLS connection with the client or nil if
+// the session is not using TLS.
+func (s *session) tlsState() *tls.ConnectionState {
+	tlsConn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// interrupt wakes up the session if it is waiting for the client's command so
+// that it can notice that the server is shutting down. It is safe to call
+// from other goroutines.
+func (s *session) interrupt() {
+	s.rawConn.SetReadDeadline(time.Now())
+}
+
+// terminate forcibly closes the client connection. It is safe to call from
+// other goroutines.
+func (s *session) terminate() {
+	atomic.StoreInt32(&s.terminated, 1)
+	s.cancel()
+	s.rawConn.Close()
+}
+
+// sessionStatus is the part of the session state which is published for the
+// purpose of monitoring.
+type sessionStatus struct {
+	state    int
+	username string
+	command  string
+}
+
+// publishStatus makes the current state of the session visible to other
+// goroutines along with the name of the command being processed. A session
+// about to be terminated is still reported in the state it was last in, since
+// terminating is not a state of its own in RFC 1939. It must only be called
+// from the session's goroutine.
+func (s *session) publishStatus(command string) {
+	status := sessionStatus{state: s.state, command: command}
+	if s.state == stateTerminateConnection {
+		status.state = s.status.state
+	}
+	if status.state != stateAuthorization {
+		status.username = s.username
+	}
+	s.statusMu.Lock()
+	s.status = status
+	s.statusMu.Unlock()
+}
+
+// info returns a snapshot of the session. It is safe to call from other
+// goroutines.
+func (s *session) info() SessionInfo {
+	s.statusMu.Lock()
+	status := s.status
+	s.statusMu.Unlock()
+	return SessionInfo{
+		ID:         s.id,
+		RemoteAddr: s.rawConn.RemoteAddr(),
+		Username:   status.username,
+		State:      stateNames[status.state],
+		Started:    s.started,
+		Command:    status.command,
+		BytesSent:  atomic.LoadUint64(&s.bytesSent),
 	}
 }
 
+// closeConn closes whatever connection the session is currently using. Since
+// STLS replaces the connection it is not safe to defer s.conn.Close directly.
+func (s *session) closeConn() {
+	s.conn.Close()
+}
+
 // closer provides a wrapper that allows deferred 'Close' operations to have
 // their errors reported to the session error handler.
 func (s *session) closeOrReport(closer io.Closer) {
 	if err := closer.Close(); err != nil {
-		s.handler.HandleSessionError(err)
+		s.reportError(err)
 	}
 }
+
+// reportError passes an error to the handler's HandleSessionError method.
+func (s *session) reportError(err error) {
+	s.handler.HandleSessionError(context.WithoutCancel(s.ctx), err)
+}
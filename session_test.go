@@ -0,0 +1,218 @@
+package popart
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for "localhost".
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// blockingMailbox blocks in GetMessageReader until the context is cancelled,
+// and in DeleteMessages until told to proceed, failing if the context has been
+// cancelled by then.
+type blockingMailbox struct {
+	*testMailbox
+	started   chan struct{}
+	cancelled chan struct{}
+	deleting  chan struct{}
+	proceed   chan struct{}
+}
+
+func (m *blockingMailbox) GetMessageReader(ctx context.Context, number uint64) (io.ReadCloser, error) {
+	close(m.started)
+	<-ctx.Done()
+	close(m.cancelled)
+	return nil, ctx.Err()
+}
+
+func (m *blockingMailbox) DeleteMessages(ctx context.Context, numbers []uint64) error {
+	close(m.deleting)
+	<-m.proceed
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.testMailbox.DeleteMessages(ctx, numbers)
+}
+
+type blockingBackend struct {
+	*testBackend
+	mailbox *blockingMailbox
+}
+
+func (b *blockingBackend) Login(ctx context.Context, username, password string) (Mailbox, error) {
+	return b.mailbox, nil
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{
+		testBackend: newTestBackend(),
+		mailbox: &blockingMailbox{
+			testMailbox: &testMailbox{messages: []string{"hello\r\n", "world\r\n"}},
+			started:     make(chan struct{}),
+			cancelled:   make(chan struct{}),
+			deleting:    make(chan struct{}),
+			proceed:     make(chan struct{}),
+		},
+	}
+}
+
+func TestContextCancelledOnDisconnectDuringCommand(t *testing.T) {
+	backend := newBlockingBackend()
+	listener := serveTest(t, &Server{Backend: backend})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "RETR 1")
+	<-backend.mailbox.started
+	client.conn.Close()
+	select {
+	case <-backend.mailbox.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled after the client disconnected")
+	}
+}
+
+func TestUpdateCompletesAfterClientLeavesOnQUIT(t *testing.T) {
+	backend := newBlockingBackend()
+	listener := serveTest(t, &Server{Backend: backend})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "DELE 2")
+	client.writer.PrintfLine("QUIT")
+	<-backend.mailbox.deleting
+	client.conn.Close()
+	time.Sleep(50 * time.Millisecond) // give the server time to notice
+	close(backend.mailbox.proceed)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, unlocks := backend.mailbox.lockCounts(); unlocks > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	backend.mailbox.mu.Lock()
+	defer backend.mailbox.mu.Unlock()
+	if deleted := backend.mailbox.deleted; len(deleted) != 1 || deleted[0] != 2 {
+		t.Errorf("deleted messages %v, expected [2]", deleted)
+	}
+}
+
+func TestPipelinedCommandsAreNotLost(t *testing.T) {
+	listener := serveTest(t, &Server{Backend: newTestBackend("a\r\n", "bc\r\n")})
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	if err := client.writer.PrintfLine("STAT\r\nLIST 2\r\nNOOP"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"+OK 2 7", "+OK 2 4", "+OK doing nothing"} {
+		if line := client.line(); line != expected {
+			t.Errorf("got %q, expected %q", line, expected)
+		}
+	}
+}
+
+func TestCommandsOverSTLS(t *testing.T) {
+	srv := &Server{
+		Backend:   newTestBackend("Subject: test\r\n\r\nhello\r\n"),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}
+	listener := serveTest(t, srv)
+	client := listener.dial(t)
+	client.line()
+	client.expect("+OK", "STLS")
+	tlsConn := tls.Client(client.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client = newTestClient(t, tlsConn)
+	client.expect("+OK", "USER alice")
+	client.expect("+OK", "PASS secret")
+	for i := 0; i < 3; i++ {
+		client.expect("+OK", "RETR 1")
+		if lines := client.lines(); len(lines) != 3 || lines[2] != "hello" {
+			t.Fatalf("unexpected message: %q", lines)
+		}
+	}
+	client.expect("+OK", "QUIT")
+}
+
+func TestSTLSForgetsPlaintextUsername(t *testing.T) {
+	srv := &Server{
+		Backend:   newTestBackend(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+	}
+	client := serveTest(t, srv).dial(t)
+	client.line()
+	client.expect("+OK", "USER alice")
+	client.expect("+OK", "STLS")
+	tlsConn := tls.Client(client.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client = newTestClient(t, tlsConn)
+	client.expect("-ERR please provide username first", "PASS secret")
+	client.expect("+OK", "USER alice")
+	client.expect("+OK", "PASS secret")
+}
+
+func TestWriteTop(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	for _, tc := range []struct {
+		name      string
+		message   string
+		bodyLines uint64
+		expected  string
+	}{
+		{"no body lines", "A: 1\r\nB: 2\r\n\r\nbody\r\n", 0, "A: 1\r\nB: 2\r\n\r\n"},
+		{"some body lines", "A: 1\r\n\r\n1\r\n2\r\n3\r\n", 2, "A: 1\r\n\r\n1\r\n2\r\n"},
+		{"more lines than body", "A: 1\r\n\r\n1\r\n", 5, "A: 1\r\n\r\n1\r\n"},
+		{"body without final line ending", "A: 1\r\n\r\n1\r\n2", 5, "A: 1\r\n\r\n1\r\n2"},
+		{"folded header", "A: 1\r\n 2\r\n\t3\r\nB: 4\r\n\r\nbody\r\n", 0, "A: 1\r\n 2\r\n\t3\r\nB: 4\r\n\r\n"},
+		{"LF line endings", "A: 1\nB: 2\n\n1\n2\n", 1, "A: 1\nB: 2\n\n1\n"},
+		{"no body", "A: 1\r\nB: 2\r\n", 3, "A: 1\r\nB: 2\r\n"},
+		{"no body nor line ending", "A: 1", 0, "A: 1"},
+		{"empty body", "A: 1\r\n\r\n", 3, "A: 1\r\n\r\n"},
+		{"long header", "A: " + long + "\r\n\r\nbody\r\n", 0, "A: " + long + "\r\n\r\n"},
+		{"long body line", "A: 1\r\n\r\n" + long + "\r\n2\r\n3\r\n", 2, "A: 1\r\n\r\n" + long + "\r\n2\r\n"},
+		{"long line split before LF", "A: 1\r\n\r\n" + long[:4095] + "\r\n\r\n2\r\n", 1, "A: 1\r\n\r\n" + long[:4095] + "\r\n"},
+	} {
+		var out strings.Builder
+		if err := writeTop(&out, strings.NewReader(tc.message), tc.bodyLines); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if out.String() != tc.expected {
+			t.Errorf("%s: got %q, expected %q", tc.name, out.String(), tc.expected)
+		}
+	}
+}
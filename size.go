@@ -0,0 +1,222 @@
+package popart
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// SizeStore keeps exact message sizes measured by the server (see the
+// Server's ExactSizes setting) across sessions, so that each message has to be
+// read only once rather than upon every login. Sizes are keyed by the username
+// and the unique ID of the message, which must not change for as long as the
+// message exists (RFC 1939, page 12). It must be safe for concurrent use by
+// multiple sessions.
+type SizeStore interface {
+	// GetSizes returns the recorded sizes of the user's messages with the
+	// given unique IDs. Messages whose size is unknown are left out.
+	GetSizes(ctx context.Context, username string, ids []string) (map[string]uint64, error)
+
+	// RecordSizes records sizes of the user's messages keyed by their
+	// unique IDs.
+	RecordSizes(ctx context.Context, username string, sizes map[string]uint64) error
+
+	// ForgetSizes is called once messages with the given unique IDs have
+	// been deleted so that their sizes can be discarded.
+	ForgetSizes(ctx context.Context, username string, ids []string) error
+}
+
+// NewMemorySizeStore returns a SizeStore which keeps all the sizes in memory,
+// so they are lost when the process exits. Sizes of messages deleted other
+// than with the DELE command are never discarded.
+func NewMemorySizeStore() SizeStore {
+	return &memorySizes{sizes: make(map[string]map[string]uint64)}
+}
+
+type memorySizes struct {
+	mu    sync.Mutex
+	sizes map[string]map[string]uint64
+}
+
+func (m *memorySizes) GetSizes(ctx context.Context, username string, ids []string) (map[string]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string]uint64)
+	for _, id := range ids {
+		if size, known := m.sizes[username][id]; known {
+			ret[id] = size
+		}
+	}
+	return ret, nil
+}
+
+func (m *memorySizes) RecordSizes(ctx context.Context, username string, sizes map[string]uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userSizes, exists := m.sizes[username]
+	if !exists {
+		userSizes = make(map[string]uint64)
+		m.sizes[username] = userSizes
+	}
+	for id, size := range sizes {
+		userSizes[id] = size
+	}
+	return nil
+}
+
+func (m *memorySizes) ForgetSizes(ctx context.Context, username string, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	userSizes := m.sizes[username]
+	for _, id := range ids {
+		delete(userSizes, id)
+	}
+	if len(userSizes) == 0 {
+		delete(m.sizes, username)
+	}
+	return nil
+}
+
+// octetCounter is an io.Writer which counts octets the way they would appear
+// on the wire after passing through textproto's DotWriter: with line endings
+// normalised to CRLF, a final CRLF added if missing, but without dot escapes
+// and the termination line.
+type octetCounter struct {
+	count uint64
+	state int
+}
+
+const (
+	counterBegin = iota
+	counterBeginLine
+	counterData
+	counterCR
+)
+
+func (c *octetCounter) Write(b []byte) (int, error) {
+	for _, octet := range b {
+		switch c.state {
+		case counterBegin, counterBeginLine, counterData:
+			c.state = counterData
+			if octet == '\r' {
+				c.state = counterCR
+			}
+			if octet == '\n' {
+				c.count++ // inserted CR
+				c.state = counterBeginLine
+			}
+		case counterCR:
+			c.state = counterData
+			if octet == '\n' {
+				c.state = counterBeginLine
+			}
+		}
+		c.count++
+	}
+	return len(b), nil
+}
+
+// size returns the final number of octets, including the line ending which
+// would be added to a message not ending with one.
+func (c *octetCounter) size() uint64 {
+	switch c.state {
+	case counterBeginLine:
+		return c.count
+	case counterCR:
+		return c.count + 1
+	default:
+		return c.count + 2
+	}
+}
+
+// measureMessages replaces sizes obtained from the handler with exact numbers
+// of octets sent to the client in response to the RETR command. Unless the
+// handler implements ExactSizer, messages not found in the Server's SizeStore
+// are read in full to measure them.
+func (s *session) measureMessages() error {
+	if sizer, ok := unwrapHandler(s.handler).(ExactSizer); ok {
+		for msgID := range s.msgSizes {
+			size, err := sizer.GetExactMessageSize(s.ctx, msgID)
+			if err != nil {
+				return err
+			}
+			s.msgSizes[msgID] = size
+		}
+		return nil
+	}
+	ids := make(map[uint64]string, len(s.msgSizes))
+	idList := make([]string, 0, len(s.msgSizes))
+	for msgID := range s.msgSizes {
+		id, err := s.getMessageID(msgID)
+		if err != nil {
+			return err
+		}
+		ids[msgID] = id
+		idList = append(idList, id)
+	}
+	known, err := s.server.SizeStore.GetSizes(s.ctx, s.username, idList)
+	if err != nil {
+		return err
+	}
+	measured := make(map[string]uint64)
+	for msgID, id := range ids {
+		size, isKnown := known[id]
+		if !isKnown {
+			if size, err = s.countMessageOctets(msgID); err != nil {
+				return err
+			}
+			measured[id] = size
+		}
+		s.msgSizes[msgID] = size
+	}
+	if len(measured) == 0 {
+		return nil
+	}
+	return s.server.SizeStore.RecordSizes(s.ctx, s.username, measured)
+}
+
+// storesSizes tells whether measureMessages keeps sizes in the Server's
+// SizeStore.
+func (s *session) storesSizes() bool {
+	if !s.server.ExactSizes {
+		return false
+	}
+	_, hasSizer := unwrapHandler(s.handler).(ExactSizer)
+	return !hasSizer
+}
+
+// forgetSizes discards sizes of deleted messages kept in the Server's
+// SizeStore.
+func (s *session) forgetSizes(deletedIDs []string) error {
+	if !s.storesSizes() || len(deletedIDs) == 0 {
+		return nil
+	}
+	return s.server.SizeStore.ForgetSizes(s.ctx, s.username, deletedIDs)
+}
+
+func (s *session) countMessageOctets(msgID uint64) (uint64, error) {
+	readCloser, err := s.handler.GetMessageReader(s.ctx, msgID)
+	if err != nil {
+		return 0, err
+	}
+	defer s.closeOrReport(readCloser)
+	counter := &octetCounter{}
+	if _, err := io.Copy(counter, readCloser); err != nil {
+		return 0, err
+	}
+	return counter.size(), nil
+}
+
+// verifySize reports a session error if the number of octets actually sent
+// to the client differs from the one previously announced.
+func (s *session) verifySize(msgID uint64, counter *octetCounter) {
+	if sent := counter.size(); sent != s.msgSizes[msgID] {
+		s.reportError(fmt.Errorf(
+			"message %d: announced %d octets, sent %d",
+			msgID,
+			s.msgSizes[msgID],
+			sent,
+		))
+	}
+}
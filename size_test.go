@@ -0,0 +1,52 @@
+package popart
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOctetCounter(t *testing.T) {
+	for data, expected := range map[string]uint64{
+		"":               2,
+		"a":              3,
+		"a\r\n":          3,
+		"a\n":            3,
+		"a\r":            3,
+		"a\nb\r\nc":      9,
+		"\r\n\r\n":       4,
+		".dot\r\n..\r\n": 10,
+	} {
+		counter := &octetCounter{}
+		counter.Write([]byte(data))
+		if size := counter.size(); size != expected {
+			t.Errorf("size of %q = %d, expected %d", data, size, expected)
+		}
+	}
+}
+
+func TestExactSizesAreMeasuredOnce(t *testing.T) {
+	backend := newTestBackend("a\nb", "c\r\n")
+	store := NewMemorySizeStore()
+	listener := serveTest(t, &Server{Backend: backend, ExactSizes: true, SizeStore: store})
+	for i := 0; i < 2; i++ {
+		client := listener.dial(t)
+		client.login("alice", "secret")
+		client.expect("+OK 2 9", "STAT")
+		client.expect("+OK", "QUIT")
+		if reads := backend.mailbox.readCount(); reads != 2 {
+			t.Fatalf("session %d: messages read %d times, expected 2", i+1, reads)
+		}
+	}
+
+	client := listener.dial(t)
+	client.login("alice", "secret")
+	client.expect("+OK", "DELE 1")
+	client.expect("+OK", "QUIT")
+	sizes, err := store.GetSizes(context.Background(), "alice", []string{"x", "xx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := sizes["x"]; known || sizes["xx"] != 3 {
+		t.Errorf("unexpected sizes after deleting the first message: %v", sizes)
+	}
+}
@@ -0,0 +1,252 @@
+package popart
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	errUserLocked          = NewCodedError(CodeAuth, "too many failed attempts, account temporarily locked")
+	errPeerLocked          = NewCodedError(CodeSysTemp, "too many failed attempts from your address, try again later")
+	errTooManyAuthFailures = NewCodedError(CodeAuth, "too many failed attempts, closing connection")
+)
+
+// AuthThrottle protects the server against password guessing by slowing down
+// and eventually refusing clients which keep failing to authenticate. Failures
+// are counted separately for each username and each IP address.
+type AuthThrottle struct {
+	// Store keeps track of authentication failures. Sharing a single store
+	// between multiple servers makes them enforce the limits together. By
+	// default failures are kept in memory.
+	Store FailureStore
+
+	// Delay is how long the server waits before responding to a failed
+	// authentication attempt. It is doubled for each subsequent failure
+	// for the same username or IP address, up to MaxDelay.
+	Delay time.Duration
+
+	// MaxDelay limits the delay. Zero means no limit.
+	MaxDelay time.Duration
+
+	// MaxSessionFailures is the number of failed attempts after which the
+	// connection is closed. Zero means no limit.
+	MaxSessionFailures int
+
+	// MaxFailures is the number of failed attempts after which the user
+	// or IP address is locked out. Zero means no lockouts.
+	MaxFailures int
+
+	// Lockout is how long failures are remembered, which is also how long
+	// a lockout lasts after the most recent failure. The default is 15
+	// minutes.
+	Lockout time.Duration
+}
+
+// FailureStore keeps track of authentication failures. It must be safe for
+// concurrent use by multiple sessions.
+type FailureStore interface {
+	// Failures returns the number of failures recorded for the key which
+	// have not yet been forgotten.
+	Failures(ctx context.Context, key string) (int, error)
+
+	// RecordFailure records a failure for the key and returns the number
+	// of failures recorded for it so far. All failures for the key should
+	// be forgotten once ttl passes without any new ones.
+	RecordFailure(ctx context.Context, key string, ttl time.Duration) (int, error)
+
+	// Reset forgets all failures recorded for the key.
+	Reset(ctx context.Context, key string) error
+}
+
+func (t *AuthThrottle) applyDefaults() {
+	if t.Store == nil {
+		t.Store = NewMemoryFailureStore()
+	}
+	if t.Lockout <= 0 {
+		t.Lockout = 15 * time.Minute
+	}
+}
+
+// NewMemoryFailureStore returns a FailureStore which keeps all failures in
+// memory.
+func NewMemoryFailureStore() FailureStore {
+	return &memoryFailures{entries: make(map[string]*failureEntry)}
+}
+
+type failureEntry struct {
+	count   int
+	expires time.Time
+}
+
+type memoryFailures struct {
+	mu        sync.Mutex
+	entries   map[string]*failureEntry
+	lastSweep time.Time
+}
+
+func (m *memoryFailures) Failures(ctx context.Context, key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, exists := m.entries[key]
+	if !exists || time.Now().After(entry.expires) {
+		return 0, nil
+	}
+	return entry.count, nil
+}
+
+func (m *memoryFailures) RecordFailure(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sweep(now, ttl)
+	entry, exists := m.entries[key]
+	if !exists || now.After(entry.expires) {
+		entry = &failureEntry{}
+		m.entries[key] = entry
+	}
+	entry.count++
+	entry.expires = now.Add(ttl)
+	return entry.count, nil
+}
+
+func (m *memoryFailures) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// sweep drops expired entries, at most once per ttl so that the cost is
+// spread across many calls.
+func (m *memoryFailures) sweep(now time.Time, ttl time.Duration) {
+	if now.Sub(m.lastSweep) < ttl {
+		return
+	}
+	m.lastSweep = now
+	for key, entry := range m.entries {
+		if now.After(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func userFailureKey(username string) string {
+	return "user:" + username
+}
+
+func peerFailureKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkAuthLockout refuses to authenticate the client if either its IP
+// address or the user (if already known) has been locked out.
+func (s *session) checkAuthLockout(username string) error {
+	throttle := s.server.AuthThrottle
+	if throttle == nil || throttle.MaxFailures <= 0 {
+		return nil
+	}
+	failures, err := throttle.Store.Failures(s.ctx, peerFailureKey(peerIP(s.rawConn.RemoteAddr())))
+	if err != nil {
+		return err
+	}
+	if failures >= throttle.MaxFailures {
+		return errPeerLocked
+	}
+	if username == "" {
+		return nil
+	}
+	if failures, err = throttle.Store.Failures(s.ctx, userFailureKey(username)); err != nil {
+		return err
+	}
+	if failures >= throttle.MaxFailures {
+		return errUserLocked
+	}
+	return nil
+}
+
+// authFailed records a failed authentication attempt and delays the response
+// accordingly. It returns the error to report to the client, closing the
+// connection if the client has failed too many times. Reportable errors
+// without a response code are given the AUTH one since the server announces
+// AUTH-RESP-CODE (RFC 3206, page 3).
+func (s *session) authFailed(username string, authErr error) error {
+	if authErr == errAuthCancelled || authErr == errUserLocked || authErr == errPeerLocked {
+		return authErr // not an attempt to authenticate
+	}
+	reportable, isReportable := authErr.(*ReportableError)
+	if !isReportable {
+		return authErr // not a failure of the client
+	}
+	if reportable.code == "" {
+		authErr = &ReportableError{code: CodeAuth, message: reportable.message}
+	}
+	throttle := s.server.AuthThrottle
+	if throttle == nil {
+		return authErr
+	}
+	failures, err := throttle.Store.RecordFailure(s.ctx, peerFailureKey(peerIP(s.rawConn.RemoteAddr())), throttle.Lockout)
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		userFailures, err := throttle.Store.RecordFailure(s.ctx, userFailureKey(username), throttle.Lockout)
+		if err != nil {
+			return err
+		}
+		if userFailures > failures {
+			failures = userFailures
+		}
+	}
+	if err := s.sleep(throttle.delay(failures)); err != nil {
+		return err
+	}
+	s.authFailures++
+	if throttle.MaxSessionFailures > 0 && s.authFailures >= throttle.MaxSessionFailures {
+		s.state = stateTerminateConnection
+		return errTooManyAuthFailures
+	}
+	return authErr
+}
+
+// authSucceeded forgets failures recorded for the user. Failures recorded for
+// the IP address are kept since one valid account should not let the client
+// keep guessing passwords of others.
+func (s *session) authSucceeded(username string) error {
+	throttle := s.server.AuthThrottle
+	if throttle == nil {
+		return nil
+	}
+	return throttle.Store.Reset(s.ctx, userFailureKey(username))
+}
+
+// delay calculates how long to wait after the given number of failures.
+func (t *AuthThrottle) delay(failures int) time.Duration {
+	delay := t.Delay
+	for i := 1; i < failures && delay > 0 && delay <= math.MaxInt64/2; i++ {
+		if t.MaxDelay > 0 && delay >= t.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+	if t.MaxDelay > 0 && delay > t.MaxDelay {
+		return t.MaxDelay
+	}
+	return delay
+}
+
+// sleep waits for the given time unless the session gets cancelled first.
+func (s *session) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
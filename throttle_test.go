@@ -0,0 +1,60 @@
+package popart
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func plainResponse(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+func TestSASLFailuresAreChargedToUser(t *testing.T) {
+	store := NewMemoryFailureStore()
+	srv := &Server{
+		Backend:      newTestBackend(),
+		AuthThrottle: &AuthThrottle{Store: store, MaxFailures: 3},
+	}
+	listener := serveTest(t, srv)
+	client := listener.dial(t)
+	client.line()
+	client.expect("-ERR", "AUTH PLAIN %s", plainResponse("bob", "wrong"))
+
+	failures, err := store.Failures(context.Background(), userFailureKey("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 {
+		t.Errorf("got %d failures for bob, expected 1", failures)
+	}
+}
+
+func TestSASLLockoutDoesNotRevealPassword(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryFailureStore()
+	for i := 0; i < 3; i++ {
+		if _, err := store.RecordFailure(ctx, userFailureKey("alice"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{
+		Backend:      newTestBackend(),
+		AuthThrottle: &AuthThrottle{Store: store, MaxFailures: 3},
+	}
+	listener := serveTest(t, srv)
+	client := listener.dial(t)
+	client.line()
+	right := client.cmd("AUTH PLAIN %s", plainResponse("alice", "secret"))
+	wrong := client.cmd("AUTH PLAIN %s", plainResponse("alice", "wrong"))
+	if right != "-ERR "+errUserLocked.Error() {
+		t.Errorf("correct password: got %q", right)
+	}
+	if right != wrong {
+		t.Errorf("responses differ: %q for the correct password, %q for a wrong one", right, wrong)
+	}
+	if failures, _ := store.Failures(ctx, userFailureKey("alice")); failures != 3 {
+		t.Errorf("refused attempts were counted as failures: got %d", failures)
+	}
+}
@@ -3,29 +3,34 @@ package popart
 var (
 	errInvalidSyntax   = NewReportableError("invalid syntax")
 	errUnexpectedState = NewReportableError("unexpected state transition")
+	errTLSRequired     = NewCodedError(CodeAuth, "TLS required for authentication")
+	errShuttingDown    = NewCodedError(CodeSysTemp, "server shutting down")
 )
 
 var (
 	validators = map[string]*validator{
-		"APOP": validates(state(stateAuthorization), arity(2)),
+		"APOP": validates(state(stateAuthorization), arity(2), secure()),
+		"AUTH": validates(state(stateAuthorization), arity(1, 2), secure()),
 		"CAPA": validates(state(stateAuthorization, stateTransaction), arity(0)),
 		"DELE": validates(state(stateTransaction), arity(1)),
 		"LIST": validates(state(stateTransaction), arity(0, 1)),
 		"NOOP": validates(state(stateTransaction), arity(0)),
-		"PASS": validates(state(stateAuthorization), arity(1)),
+		"PASS": validates(state(stateAuthorization), arity(1), secure()),
 		"QUIT": validates(state(stateAuthorization, stateTransaction), arity(0)),
 		"RETR": validates(state(stateTransaction), arity(1)),
 		"RSET": validates(state(stateTransaction), arity(0)),
 		"STAT": validates(state(stateTransaction), arity(0)),
+		"STLS": validates(state(stateAuthorization), arity(0)),
 		"TOP":  validates(state(stateTransaction), arity(2)),
 		"UIDL": validates(state(stateTransaction), arity(0, 1)),
-		"USER": validates(state(stateAuthorization), arity(1)),
+		"USER": validates(state(stateAuthorization), arity(1), secure()),
 	}
 )
 
 type validator struct {
 	allowedStates  []int
 	allowedArities []int
+	requiresTLS    bool
 }
 
 type option func(*validator)
@@ -42,7 +47,10 @@ func (v *validator) validate(s *session, args []string) error {
 	if err := v.allowedState(s); err != nil {
 		return err
 	}
-	return v.allowedArity(args)
+	if err := v.allowedArity(args); err != nil {
+		return err
+	}
+	return v.allowedConnection(s)
 }
 
 func (v *validator) allowedState(s *session) error {
@@ -63,6 +71,15 @@ func (v *validator) allowedArity(args []string) error {
 	return errInvalidSyntax
 }
 
+// allowedConnection enforces the server's RequireTLS policy for commands which
+// transmit credentials.
+func (v *validator) allowedConnection(s *session) error {
+	if v.requiresTLS && s.server.RequireTLS && !s.isTLS() {
+		return errTLSRequired
+	}
+	return nil
+}
+
 func state(states ...int) option {
 	return func(v *validator) {
 		v.allowedStates = states
@@ -74,3 +91,11 @@ func arity(arities ...int) option {
 		v.allowedArities = arities
 	}
 }
+
+// secure marks a command as one which should not be allowed over plaintext
+// connections if the server requires TLS.
+func secure() option {
+	return func(v *validator) {
+		v.requiresTLS = true
+	}
+}